@@ -14,35 +14,69 @@
    limitations under the License.
 */
 
-// flac-example-decoder decodes a FLAC file to WAV or raw PCM on stdout.
+// flac-example-decoder decodes a FLAC file, native, in Ogg or in MP4, to WAV or
+// raw PCM on stdout, or splits a single-image FLAC into one file per track of
+// its cue sheet.
 //
 // Usage:
 //
 //	flac-example-decoder [-format wav|pcm] <input.flac | ->
+//	flac-example-decoder -split dir [-format wav|pcm|flac] [-cue file.cue]
+//	    [-pregap append|prepend|discard] <input.flac | ->
 //
 //nolint:gosec // Integer conversions are bounded by audio format constraints; file paths from CLI args.
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strings"
 
 	flac "github.com/mycophonic/saprobe-flac"
 	"github.com/mycophonic/saprobe-flac/version"
 )
 
-const formatWAV = "wav"
+const (
+	formatWAV  = "wav"
+	formatPCM  = "pcm"
+	formatFLAC = "flac"
+)
+
+//nolint:gochecknoglobals
+var pregapModes = map[string]flac.PregapMode{
+	"append":  flac.PregapAppend,
+	"prepend": flac.PregapPrepend,
+	"discard": flac.PregapDiscard,
+}
+
+// splitConfig holds the -split flags.
+type splitConfig struct {
+	dir     string
+	cuePath string
+	pregap  flac.PregapMode
+}
 
 func main() {
 	showVersion := flag.Bool("version", false, "print version and exit")
-	outputFormat := flag.String("format", formatWAV, "output format: wav or pcm")
+	outputFormat := flag.String("format", formatWAV, "output format: wav or pcm, or flac with -split")
+	splitDir := flag.String("split", "", "write one file per cue sheet track to `dir`")
+	cuePath := flag.String("cue", "", "split by an external .cue `file` instead of the embedded cue sheet")
+	pregap := flag.String("pregap", "append",
+		"with -split, pregap audio goes to the end of the previous track (append), "+
+			"the start of its own track (prepend) or nowhere (discard)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [-format wav|pcm] <input.flac | ->\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -split dir [-format wav|pcm|flac] [-cue file.cue] "+
+			"[-pregap append|prepend|discard] <input.flac | ->\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -58,7 +92,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *outputFormat != formatWAV && *outputFormat != "pcm" {
+	if *splitDir != "" {
+		mode, ok := pregapModes[*pregap]
+		if !ok || (*outputFormat != formatWAV && *outputFormat != formatPCM && *outputFormat != formatFLAC) {
+			fmt.Fprintf(os.Stderr, "unknown format %q or pregap %q\n", *outputFormat, *pregap)
+			os.Exit(1)
+		}
+
+		os.Exit(runSplit(*outputFormat, flag.Arg(0), splitConfig{dir: *splitDir, cuePath: *cuePath, pregap: mode}))
+	}
+
+	if *outputFormat != formatWAV && *outputFormat != formatPCM {
 		fmt.Fprintf(os.Stderr, "unknown format %q (use wav or pcm)\n", *outputFormat)
 		os.Exit(1)
 	}
@@ -67,16 +111,39 @@ func main() {
 }
 
 func run(outputFormat, inputPath string) int {
-	reader, cleanup, err := openInput(inputPath)
+	dec, ogg, err := openDecoder(inputPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "decode: %v\n", err)
 
 		return 1
 	}
 
-	defer cleanup()
+	defer dec.Close()
+
+	pcmFormat := dec.Format()
+	frameSize := int64(pcmFormat.Channels) * int64(pcmFormat.BitDepth.BytesPerSample())
+	// Zero when STREAMINFO does not know the length, or when Ogg links may follow.
+	size := int64(dec.Metadata().StreamInfo.TotalSamples) * frameSize
+	if ogg {
+		size = 0
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+
+	if outputFormat == formatWAV {
+		if err := writeWAVHeader(out, pcmFormat, size); err != nil {
+			fmt.Fprintf(os.Stderr, "write: %v\n", err)
+
+			return 1
+		}
+	}
+
+	// Stream the PCM: memory stays bounded whatever the input length.
+	written, err := copyPCM(out, dec, pcmFormat)
+	if err == nil {
+		err = out.Flush()
+	}
 
-	pcm, pcmFormat, err := flac.Decode(reader)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "decode: %v\n", err)
 
@@ -84,16 +151,45 @@ func run(outputFormat, inputPath string) int {
 	}
 
 	fmt.Fprintf(os.Stderr, "%d Hz, %d-bit, %d ch, %d bytes PCM\n",
-		pcmFormat.SampleRate, pcmFormat.BitDepth, pcmFormat.Channels, len(pcm))
+		pcmFormat.SampleRate, pcmFormat.BitDepth, pcmFormat.Channels, written)
 
-	if outputFormat == formatWAV {
-		err = writeWAV(os.Stdout, pcm, pcmFormat)
-	} else {
-		_, err = os.Stdout.Write(pcm)
+	return 0
+}
+
+func runSplit(outputFormat, inputPath string, cfg splitConfig) int {
+	dec, _, err := openDecoder(inputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "decode: %v\n", err)
+
+		return 1
+	}
+
+	defer dec.Close()
+
+	opts := flac.SplitOptions{Pregap: cfg.pregap}
+
+	if cfg.cuePath != "" {
+		if opts.Cue, opts.CueSheet, err = loadCue(cfg.cuePath, dec); err != nil {
+			fmt.Fprintf(os.Stderr, "cue: %v\n", err)
+
+			return 1
+		}
+	}
+
+	if err := os.MkdirAll(cfg.dir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+
+		return 1
 	}
 
+	err = dec.Split(opts, func(track flac.SplitTrack, pcm io.Reader) error {
+		path := filepath.Join(cfg.dir, trackFileName(track, outputFormat))
+		fmt.Fprintf(os.Stderr, "track %02d: samples %d-%d -> %s\n", track.Number, track.Start, track.End, path)
+
+		return writeTrack(path, outputFormat, track, pcm, dec.Format())
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "write: %v\n", err)
+		fmt.Fprintf(os.Stderr, "split: %v\n", err)
 
 		return 1
 	}
@@ -101,31 +197,175 @@ func run(outputFormat, inputPath string) int {
 	return 0
 }
 
-// openInput returns a ReadSeeker for the given path, or buffers stdin when path is "-".
-func openInput(path string) (io.ReadSeeker, func(), error) {
+// loadCue parses the .cue file at path and converts it for the stream dec decodes.
+func loadCue(path string, dec *flac.Decoder) (*flac.CueFile, *flac.CueSheet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer file.Close()
+
+	cue, err := flac.ParseCueFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sheet, err := cue.CueSheet(dec.Format().SampleRate, dec.Metadata().StreamInfo.TotalSamples)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cue, sheet, nil
+}
+
+// trackFileName names a track file "NN - Title.ext", or "NN.ext" without a title.
+func trackFileName(track flac.SplitTrack, outputFormat string) string {
+	name := fmt.Sprintf("%02d", track.Number)
+
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, "TITLE") && tag.Value != "" {
+			name += " - " + strings.Map(func(r rune) rune {
+				if strings.ContainsRune(`/\:*?"<>|`, r) {
+					return '_'
+				}
+
+				return r
+			}, tag.Value)
+
+			break
+		}
+	}
+
+	return name + "." + outputFormat
+}
+
+// writeTrack writes the PCM of one track to path in outputFormat.
+func writeTrack(path, outputFormat string, track flac.SplitTrack, pcm io.Reader, pcmFmt flac.PCMFormat) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+
+	switch outputFormat {
+	case formatFLAC:
+		opts := flac.Level(flac.DefaultLevel)
+		opts.Tags = track.Tags
+
+		var enc *flac.Encoder
+
+		if enc, err = flac.NewEncoder(file, pcmFmt, opts); err == nil {
+			_, err = io.Copy(enc, pcm)
+
+			if closeErr := enc.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	case formatWAV:
+		frameSize := int64(pcmFmt.Channels) * int64(pcmFmt.BitDepth.BytesPerSample())
+
+		if err = writeWAVHeader(file, pcmFmt, int64(track.End-track.Start)*frameSize); err == nil {
+			_, err = io.Copy(file, pcm)
+		}
+	default:
+		_, err = io.Copy(file, pcm)
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// openDecoder opens the FLAC file at path, or streams stdin when path is "-".
+// Ogg FLAC is recognized by its capture pattern, and reported; MP4 files by
+// their leading ftyp box.
+func openDecoder(path string) (*flac.Decoder, bool, error) {
 	if path == "-" {
-		data, err := io.ReadAll(os.Stdin)
-		if err != nil {
-			return nil, func() {}, fmt.Errorf("reading stdin: %w", err)
+		stdin := bufio.NewReader(os.Stdin)
+		if sig, _ := stdin.Peek(len(oggCapture)); string(sig) == oggCapture {
+			dec, err := flac.NewOggDecoder(stdin)
+
+			return dec, true, err
 		}
 
-		return bytes.NewReader(data), func() {}, nil
+		dec, err := flac.NewStreamDecoder(stdin)
+
+		return dec, false, err
 	}
 
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, func() {}, fmt.Errorf("opening %s: %w", path, err)
+		return nil, false, fmt.Errorf("opening %s: %w", path, err)
 	}
 
-	return file, func() { _ = file.Close() }, nil
+	sig := make([]byte, len(mp4FileType)+4)
+	n, _ := file.ReadAt(sig, 0)
+
+	switch sig = sig[:n]; {
+	case bytes.HasPrefix(sig, []byte(oggCapture)):
+		dec, err := flac.NewOggDecoder(file)
+
+		return dec, true, err
+	case len(sig) == cap(sig) && string(sig[4:]) == mp4FileType:
+		dec, err := flac.NewMP4Decoder(file)
+
+		return dec, false, err
+	}
+
+	dec, err := flac.NewDecoder(file)
+
+	return dec, false, err
+}
+
+// copyPCM streams the decoded PCM to w. Chained Ogg links play on as long as
+// they keep the format the output started with.
+func copyPCM(w io.Writer, dec *flac.Decoder, pcmFormat flac.PCMFormat) (int64, error) {
+	var total int64
+
+	// Hide bufio.Writer.ReadFrom, which keeps the first read error for good.
+	dst := struct{ io.Writer }{w}
+
+	for {
+		n, err := io.Copy(dst, dec)
+		total += n
+
+		if !errors.Is(err, flac.ErrStreamChanged) {
+			return total, err
+		}
+
+		if next := dec.Format(); next != pcmFormat {
+			return total, fmt.Errorf("chained stream changes to %d Hz, %d-bit, %d ch",
+				next.SampleRate, next.BitDepth, next.Channels)
+		}
+	}
 }
 
-// writeWAV writes a standard PCM WAV to writer.
-func writeWAV(writer io.Writer, pcm []byte, pcmFmt flac.PCMFormat) error {
+// oggCapture opens every Ogg page, and so Ogg files.
+const oggCapture = "OggS"
+
+// mp4FileType is the type of the box opening MP4 files, after its size.
+const mp4FileType = "ftyp"
+
+// wavUnknownSize is the RIFF and data size written when the length is unknown
+// or exceeds what WAV can express, as streaming tools do.
+const wavUnknownSize = math.MaxUint32
+
+// writeWAVHeader writes a standard PCM WAV header for dataSize bytes of PCM,
+// 0 when unknown.
+func writeWAVHeader(writer io.Writer, pcmFmt flac.PCMFormat, dataSize int64) error {
 	bytesPerSample := pcmFmt.BitDepth.BytesPerSample()
 	blockAlign := int(pcmFmt.Channels) * bytesPerSample
 	byteRate := pcmFmt.SampleRate * blockAlign
-	dataSize := len(pcm)
+
+	riffSize, dataLen := uint32(wavUnknownSize), uint32(wavUnknownSize)
+	if dataSize > 0 && dataSize <= wavUnknownSize-36 {
+		riffSize, dataLen = uint32(36+dataSize), uint32(dataSize)
+	}
 
 	bitsPerSample := int(pcmFmt.BitDepth)
 	// WAV uses container bit depth (e.g., 20-bit stored in 24-bit = bitsPerSample 24).
@@ -143,7 +383,7 @@ func writeWAV(writer io.Writer, pcm []byte, pcmFmt flac.PCMFormat) error {
 	var hdr [44]byte
 
 	copy(hdr[0:4], "RIFF")
-	binary.LittleEndian.PutUint32(hdr[4:8], uint32(36+dataSize))
+	binary.LittleEndian.PutUint32(hdr[4:8], riffSize)
 	copy(hdr[8:12], "WAVE")
 
 	copy(hdr[12:16], "fmt ")
@@ -156,15 +396,11 @@ func writeWAV(writer io.Writer, pcm []byte, pcmFmt flac.PCMFormat) error {
 	binary.LittleEndian.PutUint16(hdr[34:36], uint16(bitsPerSample))
 
 	copy(hdr[36:40], "data")
-	binary.LittleEndian.PutUint32(hdr[40:44], uint32(dataSize))
+	binary.LittleEndian.PutUint32(hdr[40:44], dataLen)
 
 	if _, err := writer.Write(hdr[:]); err != nil {
 		return fmt.Errorf("writing WAV header: %w", err)
 	}
 
-	if _, err := writer.Write(pcm); err != nil {
-		return fmt.Errorf("writing WAV data: %w", err)
-	}
-
 	return nil
 }
@@ -0,0 +1,462 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidCue is returned for a malformed .cue file or a CUESHEET that
+// RFC 9639 does not allow.
+var ErrInvalidCue = errors.New("invalid cue sheet")
+
+const (
+	// cueFramesPerSecond is the resolution of .cue positions: CD sectors.
+	cueFramesPerSecond = 75
+	// cdSampleRate is the sample rate of CD-DA audio.
+	cdSampleRate = 44100
+	// cdSectorSamples is the length of a CD sector at cdSampleRate.
+	cdSectorSamples = cdSampleRate / cueFramesPerSecond
+	// cdLeadIn is the lead-in of CD-DA sheets: two seconds, as flac writes.
+	cdLeadIn = 2 * cdSampleRate
+	// cdLeadOut and leadOut are the numbers of the lead-out track.
+	cdLeadOut = 170
+	leadOut   = 255
+	// maxCDTracks is the most audio tracks a CD holds.
+	maxCDTracks = 99
+	// cueDefaultFile is the FILE written when CueFile.File is empty, as metaflac.
+	cueDefaultFile = "dummy.wav"
+)
+
+// cueUnquotable are the characters that end or split an unquoted .cue value.
+const cueUnquotable = " \t\r\n\""
+
+// cueQuoted replaces what a quoted .cue string cannot hold: the closing quote
+// and line breaks.
+//
+//nolint:gochecknoglobals
+var cueQuoted = strings.NewReplacer(`"`, "'", "\r\n", " ", "\r", " ", "\n", " ")
+
+// CueFile is a .cue text file describing the tracks of a single audio file.
+// Positions are in CD frames of 1/75 second, the resolution of the format.
+type CueFile struct {
+	// Catalog is the media catalog number (CATALOG).
+	Catalog   string
+	Performer string
+	Title     string
+	// File is the audio file the positions refer to (FILE).
+	File   string
+	Tracks []CueFileTrack
+}
+
+// CueFileTrack is a TRACK of a CueFile.
+type CueFileTrack struct {
+	Number uint8
+	// IsAudio is false for data tracks (MODE1/2352 and the like).
+	IsAudio     bool
+	Performer   string
+	Title       string
+	ISRC        string
+	PreEmphasis bool
+	Indices     []CueFileIndex
+}
+
+// CueFileIndex is an INDEX of a CueFileTrack.
+type CueFileIndex struct {
+	Number uint8
+	// Frame is the position in CD frames from the start of the file.
+	Frame uint64
+}
+
+// ParseCueFile reads a .cue file. REM comments and commands with no CUESHEET
+// or track-list counterpart (SONGWRITER, PREGAP, POSTGAP, ...) are skipped.
+// Only single-file sheets are supported, as a CUESHEET describes one stream.
+func ParseCueFile(r io.Reader) (*CueFile, error) {
+	var (
+		cue   = &CueFile{}
+		track *CueFileTrack
+		line  int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+
+		text := scanner.Text()
+		if line == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+
+		fields := cueFields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := cue.parseCommand(&track, fields); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidCue, line, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	if len(cue.Tracks) == 0 {
+		return nil, fmt.Errorf("%w: no tracks", ErrInvalidCue)
+	}
+
+	for _, track := range cue.Tracks {
+		if !track.hasIndex(1) {
+			return nil, fmt.Errorf("%w: track %d has no INDEX 01", ErrInvalidCue, track.Number)
+		}
+	}
+
+	return cue, nil
+}
+
+// parseCommand applies one line of a .cue file; track is the current TRACK.
+func (c *CueFile) parseCommand(track **CueFileTrack, fields []string) error {
+	command, args := strings.ToUpper(fields[0]), fields[1:]
+
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+
+		return ""
+	}
+
+	switch command {
+	case "CATALOG":
+		c.Catalog = arg(0)
+	case "TITLE", "PERFORMER":
+		title, performer := &c.Title, &c.Performer
+		if *track != nil {
+			title, performer = &(*track).Title, &(*track).Performer
+		}
+
+		if command == "TITLE" {
+			*title = arg(0)
+		} else {
+			*performer = arg(0)
+		}
+	case "FILE":
+		if c.File != "" && arg(0) != c.File {
+			return fmt.Errorf("second FILE %q: multi-file sheets are not supported", arg(0))
+		}
+
+		c.File = arg(0)
+	case "TRACK":
+		number, err := strconv.ParseUint(arg(0), 10, 8)
+		if err != nil || number == 0 || number > maxCDTracks {
+			return fmt.Errorf("track number %q", arg(0))
+		}
+
+		if c.File == "" {
+			return errors.New("TRACK before FILE")
+		}
+
+		c.Tracks = append(c.Tracks, CueFileTrack{Number: uint8(number), IsAudio: strings.EqualFold(arg(1), "AUDIO")})
+		*track = &c.Tracks[len(c.Tracks)-1]
+	case "ISRC", "FLAGS", "INDEX":
+		if *track == nil {
+			return fmt.Errorf("%s outside a TRACK", command)
+		}
+
+		return (*track).parseCommand(command, args)
+	}
+
+	return nil
+}
+
+// parseCommand applies a track-level command.
+func (t *CueFileTrack) parseCommand(command string, args []string) error {
+	switch command {
+	case "ISRC":
+		if len(args) > 0 {
+			t.ISRC = args[0]
+		}
+	case "FLAGS":
+		for _, flag := range args {
+			if strings.EqualFold(flag, "PRE") {
+				t.PreEmphasis = true
+			}
+		}
+	case "INDEX":
+		if len(args) < 2 {
+			return errors.New("INDEX needs a number and a position")
+		}
+
+		number, err := strconv.ParseUint(args[0], 10, 8)
+		if err != nil || number > maxCDTracks {
+			return fmt.Errorf("index number %q", args[0])
+		}
+
+		frame, err := parseCueTime(args[1])
+		if err != nil {
+			return err
+		}
+
+		if n := len(t.Indices); n > 0 && (number != uint64(t.Indices[n-1].Number)+1 || frame < t.Indices[n-1].Frame) {
+			return fmt.Errorf("INDEX %02d out of order", number)
+		} else if n == 0 && number > 1 {
+			return fmt.Errorf("track %d starts at INDEX %02d", t.Number, number)
+		}
+
+		t.Indices = append(t.Indices, CueFileIndex{Number: uint8(number), Frame: frame})
+	}
+
+	return nil
+}
+
+// hasIndex reports whether the track has the index number.
+func (t *CueFileTrack) hasIndex(number uint8) bool {
+	for _, index := range t.Indices {
+		if index.Number == number {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cueFields splits a .cue line into words, keeping double-quoted strings whole.
+func cueFields(line string) []string {
+	var fields []string
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				end = len(line) - 1
+			}
+
+			fields = append(fields, line[1:end+1])
+			line = line[min(end+2, len(line)):]
+
+			continue
+		}
+
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+
+	return fields
+}
+
+// parseCueTime parses an mm:ss:ff position into CD frames.
+func parseCueTime(text string) (uint64, error) {
+	parts := strings.Split(text, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("position %q", text)
+	}
+
+	var values [3]uint64
+
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("position %q", text)
+		}
+
+		values[i] = value
+	}
+
+	if values[1] >= 60 || values[2] >= cueFramesPerSecond {
+		return 0, fmt.Errorf("position %q", text)
+	}
+
+	return (values[0]*60+values[1])*cueFramesPerSecond + values[2], nil
+}
+
+// formatCueTime formats CD frames as an mm:ss:ff position.
+func formatCueTime(frame uint64) string {
+	seconds := frame / cueFramesPerSecond
+
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/60, seconds%60, frame%cueFramesPerSecond)
+}
+
+// WriteTo writes c as .cue text. Empty fields are omitted, and an empty File
+// is written as "dummy.wav", as metaflac does. Quoted strings cannot hold
+// double quotes or line breaks, which are written as single quotes and
+// spaces; a catalog number or ISRC with whitespace or quotes fails with
+// ErrInvalidCue.
+func (c *CueFile) WriteTo(w io.Writer) (int64, error) {
+	if err := c.checkCodes(); err != nil {
+		return 0, err
+	}
+
+	var b strings.Builder
+
+	if c.Catalog != "" {
+		fmt.Fprintf(&b, "CATALOG %s\n", c.Catalog)
+	}
+
+	writeCueString(&b, "", "PERFORMER", c.Performer)
+	writeCueString(&b, "", "TITLE", c.Title)
+
+	file := c.File
+	if file == "" {
+		file = cueDefaultFile
+	}
+
+	fmt.Fprintf(&b, "FILE \"%s\" WAVE\n", cueQuoted.Replace(file))
+
+	for _, track := range c.Tracks {
+		mode := "AUDIO"
+		if !track.IsAudio {
+			mode = "MODE1/2352"
+		}
+
+		fmt.Fprintf(&b, "  TRACK %02d %s\n", track.Number, mode)
+		writeCueString(&b, "    ", "TITLE", track.Title)
+		writeCueString(&b, "    ", "PERFORMER", track.Performer)
+
+		if track.PreEmphasis {
+			b.WriteString("    FLAGS PRE\n")
+		}
+
+		if track.ISRC != "" {
+			fmt.Fprintf(&b, "    ISRC %s\n", track.ISRC)
+		}
+
+		for _, index := range track.Indices {
+			fmt.Fprintf(&b, "    INDEX %02d %s\n", index.Number, formatCueTime(index.Frame))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+
+	return int64(n), err //nolint:wrapcheck // Writer errors pass through, as io.WriterTo.
+}
+
+// checkCodes rejects unquoted values that would not read back as one field.
+func (c *CueFile) checkCodes() error {
+	if strings.ContainsAny(c.Catalog, cueUnquotable) {
+		return fmt.Errorf("%w: catalog number %q", ErrInvalidCue, c.Catalog)
+	}
+
+	for _, track := range c.Tracks {
+		if strings.ContainsAny(track.ISRC, cueUnquotable) {
+			return fmt.Errorf("%w: track %d ISRC %q", ErrInvalidCue, track.Number, track.ISRC)
+		}
+	}
+
+	return nil
+}
+
+// writeCueString writes a quoted string command when value is not empty.
+func writeCueString(b *strings.Builder, indent, command, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s%s \"%s\"\n", indent, command, cueQuoted.Replace(value))
+	}
+}
+
+// CueSheet converts c to a CUESHEET for a stream of totalSamples samples at
+// sampleRate, which places the lead-out track. Each track starts at its first
+// index, INDEX 00 when it has a pregap. The sheet is marked CD-DA, with the
+// usual two-second lead-in, when the stream is 44.1 kHz and a whole number
+// of CD sectors long.
+func (c *CueFile) CueSheet(sampleRate int, totalSamples uint64) (*CueSheet, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("%w: sample rate %d", ErrInvalidCue, sampleRate)
+	}
+
+	rate := uint64(sampleRate)
+	isCD := rate == cdSampleRate && totalSamples%cdSectorSamples == 0
+
+	sheet := &CueSheet{MCN: c.Catalog, IsCD: isCD, Tracks: make([]CueTrack, 0, len(c.Tracks)+1)}
+	if isCD {
+		sheet.LeadIn = cdLeadIn
+	}
+
+	for _, track := range c.Tracks {
+		if len(track.Indices) == 0 {
+			return nil, fmt.Errorf("%w: track %d has no index", ErrInvalidCue, track.Number)
+		}
+
+		start := track.Indices[0].Frame * rate / cueFramesPerSecond
+		out := CueTrack{
+			Offset:      start,
+			Number:      track.Number,
+			ISRC:        track.ISRC,
+			IsAudio:     track.IsAudio,
+			PreEmphasis: track.PreEmphasis,
+			Indices:     make([]CueIndex, len(track.Indices)),
+		}
+
+		for i, index := range track.Indices {
+			out.Indices[i] = CueIndex{Offset: index.Frame*rate/cueFramesPerSecond - start, Number: index.Number}
+		}
+
+		sheet.Tracks = append(sheet.Tracks, out)
+	}
+
+	number := uint8(leadOut)
+	if isCD {
+		number = cdLeadOut
+	}
+
+	sheet.Tracks = append(sheet.Tracks, CueTrack{Offset: totalSamples, Number: number})
+
+	if err := sheet.validate(); err != nil {
+		return nil, err
+	}
+
+	return sheet, nil
+}
+
+// CueFile converts s to a .cue file naming file, for a stream at sampleRate.
+// Positions are rounded down to CD frames; the lead-out track is dropped.
+// Titles and performers are left for the caller to fill in.
+func (s *CueSheet) CueFile(sampleRate int, file string) *CueFile {
+	cue := &CueFile{Catalog: s.MCN, File: file}
+	if sampleRate <= 0 || len(s.Tracks) == 0 {
+		return cue
+	}
+
+	rate := uint64(sampleRate)
+
+	for _, track := range s.Tracks[:len(s.Tracks)-1] {
+		out := CueFileTrack{
+			Number:      track.Number,
+			IsAudio:     track.IsAudio,
+			ISRC:        track.ISRC,
+			PreEmphasis: track.PreEmphasis,
+			Indices:     make([]CueFileIndex, len(track.Indices)),
+		}
+
+		for i, index := range track.Indices {
+			frame := (track.Offset + index.Offset) * cueFramesPerSecond / rate
+			out.Indices[i] = CueFileIndex{Number: index.Number, Frame: frame}
+		}
+
+		cue.Tracks = append(cue.Tracks, out)
+	}
+
+	return cue
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+const (
+	// cueMCNSize and cueISRCSize are the CUESHEET string field lengths.
+	cueMCNSize  = 128
+	cueISRCSize = 12
+)
+
+// CueSheet is a CUESHEET block, typically describing the tracks of a CD rip.
+type CueSheet struct {
+	// Media catalog number.
+	MCN string
+	// Lead-in samples, for CD-DA sheets.
+	LeadIn uint64
+	IsCD   bool
+	// Tracks, ending with the lead-out track (170 for CD-DA, 255 otherwise).
+	Tracks []CueTrack
+}
+
+// CueTrack is one track of a CueSheet.
+type CueTrack struct {
+	// Offset of the track in samples from the start of the stream.
+	Offset      uint64
+	Number      uint8
+	ISRC        string
+	IsAudio     bool
+	PreEmphasis bool
+	Indices     []CueIndex
+}
+
+// CueIndex is an index point of a CueTrack.
+type CueIndex struct {
+	// Offset in samples from the track offset.
+	Offset uint64
+	Number uint8
+}
+
+// Type implements Block.
+func (*CueSheet) Type() BlockType { return BlockCueSheet }
+
+// cueSheetFromMeta converts goflac's CUESHEET.
+func cueSheetFromMeta(sheet *meta.CueSheet) *CueSheet {
+	cue := &CueSheet{
+		MCN:    sheet.MCN,
+		LeadIn: sheet.NLeadInSamples,
+		IsCD:   sheet.IsCompactDisc,
+		Tracks: make([]CueTrack, len(sheet.Tracks)),
+	}
+
+	for i, track := range sheet.Tracks {
+		// The lead-out track has no indices: leave them nil.
+		var indices []CueIndex
+		for _, index := range track.Indicies {
+			indices = append(indices, CueIndex{Offset: index.Offset, Number: index.Num})
+		}
+
+		cue.Tracks[i] = CueTrack{
+			Offset:      track.Offset,
+			Number:      track.Num,
+			ISRC:        track.ISRC,
+			IsAudio:     track.IsAudio,
+			PreEmphasis: track.HasPreEmphasis,
+			Indices:     indices,
+		}
+	}
+
+	return cue
+}
+
+func (c *CueSheet) appendBody(dst []byte) []byte {
+	const (
+		sheetReserved   = 258
+		trackReserved   = 13
+		indexReserved   = 3
+		cdFlag          = 0x80
+		nonAudioFlag    = 0x80
+		preEmphasisFlag = 0x40
+	)
+
+	dst = appendPadded(dst, c.MCN, cueMCNSize)
+	dst = binary.BigEndian.AppendUint64(dst, c.LeadIn)
+
+	var flags byte
+	if c.IsCD {
+		flags = cdFlag
+	}
+
+	dst = append(dst, flags)
+	dst = append(dst, make([]byte, sheetReserved)...)
+	dst = append(dst, byte(len(c.Tracks))) //nolint:gosec // At most 100 tracks.
+
+	for _, track := range c.Tracks {
+		dst = binary.BigEndian.AppendUint64(dst, track.Offset)
+		dst = append(dst, track.Number)
+		dst = appendPadded(dst, track.ISRC, cueISRCSize)
+
+		flags = 0
+		if !track.IsAudio {
+			flags |= nonAudioFlag
+		}
+
+		if track.PreEmphasis {
+			flags |= preEmphasisFlag
+		}
+
+		dst = append(dst, flags)
+		dst = append(dst, make([]byte, trackReserved)...)
+		dst = append(dst, byte(len(track.Indices))) //nolint:gosec // At most 100 indices.
+
+		for _, index := range track.Indices {
+			dst = binary.BigEndian.AppendUint64(dst, index.Offset)
+			dst = append(dst, index.Number)
+			dst = append(dst, make([]byte, indexReserved)...)
+		}
+	}
+
+	return dst
+}
+
+// validate checks the constraints RFC 9639 puts on a CUESHEET, which readers
+// enforce: a lead-out track, unique track numbers, ascending offsets and, for
+// CD-DA, sector-aligned offsets.
+func (s *CueSheet) validate() error {
+	// A track and the lead-out.
+	if len(s.Tracks) < 2 {
+		return fmt.Errorf("%w: no tracks", ErrInvalidCue)
+	}
+
+	if s.IsCD && len(s.Tracks) > maxCDTracks+1 {
+		return fmt.Errorf("%w: %d CD-DA tracks", ErrInvalidCue, len(s.Tracks)-1)
+	}
+
+	seen := make(map[uint8]bool, len(s.Tracks))
+	last := len(s.Tracks) - 1
+
+	for i, track := range s.Tracks {
+		switch {
+		case track.Number == 0 || seen[track.Number]:
+			return fmt.Errorf("%w: track number %d", ErrInvalidCue, track.Number)
+		case i == last && s.IsCD && track.Number != cdLeadOut,
+			i == last && !s.IsCD && track.Number != leadOut:
+			return fmt.Errorf("%w: lead-out track number %d", ErrInvalidCue, track.Number)
+		case i < last && s.IsCD && track.Number > maxCDTracks:
+			return fmt.Errorf("%w: CD-DA track number %d", ErrInvalidCue, track.Number)
+		case i < last && len(track.Indices) == 0:
+			return fmt.Errorf("%w: track %d has no index", ErrInvalidCue, track.Number)
+		case i > 0 && track.Offset < s.Tracks[i-1].Offset:
+			return fmt.Errorf("%w: track %d starts before track %d", ErrInvalidCue, track.Number, s.Tracks[i-1].Number)
+		case len(track.ISRC) > cueISRCSize:
+			return fmt.Errorf("%w: ISRC %q", ErrInvalidCue, track.ISRC)
+		}
+
+		seen[track.Number] = true
+
+		if !s.IsCD {
+			continue
+		}
+
+		if track.Offset%cdSectorSamples != 0 {
+			return fmt.Errorf("%w: CD-DA track %d offset %d", ErrInvalidCue, track.Number, track.Offset)
+		}
+
+		for _, index := range track.Indices {
+			if index.Offset%cdSectorSamples != 0 {
+				return fmt.Errorf("%w: CD-DA track %d index %d offset %d",
+					ErrInvalidCue, track.Number, index.Number, index.Offset)
+			}
+		}
+	}
+
+	if len(s.MCN) > cueMCNSize {
+		return fmt.Errorf("%w: media catalog number %q", ErrInvalidCue, s.MCN)
+	}
+
+	return nil
+}
@@ -17,14 +17,18 @@
 package flac
 
 import (
+	"bytes"
+	"crypto/md5" //nolint:gosec // FLAC mandates MD5 for its audio signature.
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"slices"
 
 	goflac "github.com/mewkiz/flac"
 	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
 )
 
 //nolint:gochecknoglobals
@@ -44,11 +48,45 @@ var (
 
 	// ErrReadFailure is returned when reading from the FLAC stream fails.
 	ErrReadFailure = errors.New("read failure")
+
+	// ErrMD5Mismatch is returned at the end of the stream when MD5 verification
+	// is enabled and the decoded audio does not match the STREAMINFO signature.
+	ErrMD5Mismatch = errors.New("audio MD5 mismatch")
+
+	// ErrStreamChanged is returned by Read, with no data, where a chained Ogg
+	// stream moves on to its next link. Format and Metadata then describe the
+	// new link, whose PCM the following Reads return.
+	ErrStreamChanged = errors.New("stream changed")
 )
 
+// DecoderOptions configures a Decoder.
+type DecoderOptions struct {
+	// VerifyMD5 hashes the decoded PCM and compares it with the STREAMINFO
+	// signature once the stream is exhausted. Streams without a signature
+	// (see Decoder.HasMD5) decode unverified.
+	VerifyMD5 bool
+	// Index, from BuildIndex, lets seeks jump straight to the frame holding the
+	// target sample. NewDecoder fails with ErrIndexMismatch when it does not
+	// cover the stream's samples.
+	Index *FrameIndex
+}
+
 // Decoder streams decoded PCM from a FLAC source.
 type Decoder struct {
-	stream         *goflac.Stream
+	source io.ReadSeeker
+	stream *goflac.Stream
+	info   *meta.StreamInfo
+	// Signature and STREAMINFO fed to goflac ahead of the frames when restarting after a seek.
+	preamble  []byte
+	metadata  *Metadata
+	seekTable *SeekTable
+	index     *FrameIndex
+	// Absolute offset of the first frame in source; -1 when source cannot seek,
+	// or its frames are not contiguous.
+	dataStart int64
+	// Sample tables of an MP4 source, which seeks go through; nil otherwise.
+	track *mp4Track
+
 	format         PCMFormat
 	nChannels      int
 	bytesPerSample int
@@ -58,28 +96,106 @@ type Decoder struct {
 	buf    []byte
 	bufOff int
 	eof    bool
+
+	// PCM byte offset of the next byte Read returns.
+	pos int64
+
+	// Running MD5 of the decoded PCM when verifying; nil otherwise.
+	md5 hash.Hash
+	// Sticky failure (MD5 mismatch, failed seek) returned by every later Read.
+	err error
+
+	// Opens the next link of a chained Ogg stream, or returns io.EOF; nil for
+	// other sources.
+	nextLink func() (*Decoder, error)
+}
+
+// NewDecoder opens a FLAC stream and returns a streaming decoder. Only the
+// first options value is used. The caller should call Close when done.
+func NewDecoder(rs io.ReadSeeker, opts ...DecoderOptions) (*Decoder, error) {
+	// Seeking is optional: sources that cannot report their position still decode.
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		start = -1
+	}
+
+	header, err := readStreamHeader(rs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	dataStart := int64(-1)
+	if start >= 0 {
+		dataStart = start + header.size
+	}
+
+	return newDecoder(rs, rs, header, dataStart, opts)
 }
 
-// NewDecoder opens a FLAC stream and returns a streaming decoder.
-// The caller should call Close when done.
-func NewDecoder(rs io.ReadSeeker) (*Decoder, error) {
-	stream, err := goflac.New(rs)
+// NewStreamDecoder opens a FLAC stream from a plain io.Reader such as a pipe,
+// socket or decompressor, reading it strictly forward with memory bounded by
+// the frame size. Seeking fails with ErrNotSeekable; everything else, MD5
+// verification included, works as with NewDecoder. Only the first options
+// value is used; its Index is ignored. The caller should call Close when done,
+// which closes r when it is an io.Closer.
+func NewStreamDecoder(r io.Reader, opts ...DecoderOptions) (*Decoder, error) {
+	header, err := readStreamHeader(r)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
 	}
 
-	info := stream.Info
+	if len(opts) > 0 {
+		opts = []DecoderOptions{{VerifyMD5: opts[0].VerifyMD5}}
+	}
+
+	return newDecoder(streamSource{r}, r, header, -1, opts)
+}
+
+// newDecoder returns a Decoder for the stream described by header, whose
+// frames are read from frames; source is what seeks reposition and Close closes.
+func newDecoder(source io.ReadSeeker, frames io.Reader, header *streamHeader, dataStart int64,
+	opts []DecoderOptions,
+) (*Decoder, error) {
+	info := header.info
 	nChannels := int(info.NChannels)
 
 	bitDepth := BitDepth(info.BitsPerSample)
 	if !slices.Contains(flacBitDepths, bitDepth) {
-		_ = stream.Close()
+		closeSource(source)
 
 		return nil, ErrBitDepth
 	}
 
-	return &Decoder{
+	var opt DecoderOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	if opt.Index != nil && info.NSamples != 0 && opt.Index.TotalSamples() != info.NSamples {
+		closeSource(source)
+
+		return nil, fmt.Errorf("%w: index covers %d samples, stream has %d",
+			ErrIndexMismatch, opt.Index.TotalSamples(), info.NSamples)
+	}
+
+	preamble := framePreamble(info)
+
+	stream, err := openFrames(preamble, frames)
+	if err != nil {
+		closeSource(source)
+
+		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	dec := &Decoder{
+		source:         source,
 		stream:         stream,
+		info:           info,
+		preamble:       preamble,
+		metadata:       header.metadata,
+		seekTable:      header.metadata.SeekTable(),
+		index:          opt.Index,
+		dataStart:      dataStart,
 		nChannels:      nChannels,
 		bytesPerSample: bitDepth.BytesPerSample(),
 		bitDepth:       bitDepth,
@@ -88,14 +204,58 @@ func NewDecoder(rs io.ReadSeeker) (*Decoder, error) {
 			BitDepth:   bitDepth,
 			Channels:   uint(nChannels), //nolint:gosec // nChannels comes from uint8, always fits in uint.
 		},
-	}, nil
+	}
+
+	if opt.VerifyMD5 && dec.HasMD5() {
+		dec.md5 = md5.New() //nolint:gosec // FLAC mandates MD5 for its audio signature.
+	}
+
+	return dec, nil
 }
 
 // Format returns the PCM output format.
 func (d *Decoder) Format() PCMFormat { return d.format }
 
+// Metadata returns the stream's metadata blocks, read when the decoder was
+// opened. The returned value is shared with the decoder and must not be modified.
+func (d *Decoder) Metadata() *Metadata { return d.metadata }
+
+// HasMD5 reports whether STREAMINFO carries an audio MD5. Encoders that cannot
+// seek back to the header leave it unset, in which case there is nothing to verify.
+func (d *Decoder) HasMD5() bool {
+	return d.info.MD5sum != [md5.Size]byte{}
+}
+
+// verify compares the running hash with the STREAMINFO signature once the
+// stream is exhausted.
+func (d *Decoder) verify() error {
+	if d.md5 == nil {
+		return nil
+	}
+
+	if got := d.md5.Sum(nil); !bytes.Equal(got, d.info.MD5sum[:]) {
+		d.err = fmt.Errorf("%w: decoded %x, stream info %x", ErrMD5Mismatch, got, d.info.MD5sum)
+	}
+
+	d.md5 = nil
+
+	return d.err
+}
+
 // Read reads decoded PCM bytes from the FLAC stream.
 func (d *Decoder) Read(p []byte) (int, error) { //nolint:varnamelen // p is idiomatic for io.Reader.Read
+	if d.err != nil && !d.eof {
+		return 0, d.err
+	}
+
+	total, err := d.read(p)
+	d.pos += int64(total)
+
+	return total, err
+}
+
+// read implements Read without position bookkeeping.
+func (d *Decoder) read(p []byte) (int, error) { //nolint:varnamelen // p is idiomatic for io.Reader.Read
 	total := 0
 
 	for len(p) > 0 {
@@ -110,6 +270,10 @@ func (d *Decoder) Read(p []byte) (int, error) { //nolint:varnamelen // p is idio
 		}
 
 		if d.eof {
+			if d.err != nil {
+				return total, d.err
+			}
+
 			if total > 0 {
 				return total, nil
 			}
@@ -120,12 +284,23 @@ func (d *Decoder) Read(p []byte) (int, error) { //nolint:varnamelen // p is idio
 		// Decode next frame.
 		audioFrame, parseErr := d.stream.ParseNext()
 		if errors.Is(parseErr, io.EOF) {
-			d.eof = true
+			if err := d.verify(); err != nil {
+				d.eof = true
 
+				return total, err
+			}
+
+			// Switch links on a call of its own, so no Read mixes two formats.
 			if total > 0 {
 				return total, nil
 			}
 
+			if err := d.chain(); !errors.Is(err, io.EOF) {
+				return 0, err
+			}
+
+			d.eof = true
+
 			return 0, io.EOF
 		}
 
@@ -133,36 +308,101 @@ func (d *Decoder) Read(p []byte) (int, error) { //nolint:varnamelen // p is idio
 			return total, fmt.Errorf("%w: %w", ErrReadFailure, parseErr)
 		}
 
-		blockSize := int(audioFrame.BlockSize)
-		frameBytes := blockSize * d.nChannels * d.bytesPerSample
+		d.fill(audioFrame)
 
-		// Grow frame buffer if needed.
-		if cap(d.buf) < frameBytes {
-			d.buf = make([]byte, frameBytes)
-		} else {
-			d.buf = d.buf[:frameBytes]
+		if d.md5 != nil {
+			// Our PCM layout is the one the FLAC signature hashes.
+			d.md5.Write(d.buf)
 		}
-
-		interleave(d.buf, audioFrame.Subframes, blockSize, d.nChannels, d.bitDepth)
-		d.bufOff = 0
 	}
 
 	return total, nil
 }
 
-// Close releases resources held by the FLAC stream.
+// chain switches to the next link of a chained Ogg stream, returning
+// ErrStreamChanged, or io.EOF at the end of the stream.
+func (d *Decoder) chain() error {
+	if d.nextLink == nil {
+		return io.EOF
+	}
+
+	next, err := d.nextLink()
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+
+	if err != nil {
+		d.eof, d.err = true, err
+
+		return err
+	}
+
+	next.source, next.nextLink, next.pos, next.buf = d.source, d.nextLink, d.pos, d.buf[:0]
+	*d = *next
+
+	return ErrStreamChanged
+}
+
+// fill interleaves a decoded frame into the frame buffer.
+func (d *Decoder) fill(audioFrame *frame.Frame) {
+	blockSize := int(audioFrame.BlockSize)
+	frameBytes := blockSize * d.nChannels * d.bytesPerSample
+
+	// Grow frame buffer if needed.
+	if cap(d.buf) < frameBytes {
+		d.buf = make([]byte, frameBytes)
+	} else {
+		d.buf = d.buf[:frameBytes]
+	}
+
+	interleave(d.buf, audioFrame.Subframes, blockSize, d.nChannels, d.bitDepth)
+	d.bufOff = 0
+}
+
+// Close releases resources held by the FLAC stream, closing the source if it
+// is an io.Closer.
 func (d *Decoder) Close() error {
-	if err := d.stream.Close(); err != nil {
-		return fmt.Errorf("closing flac stream: %w", err)
+	if closer, ok := d.source.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("closing flac stream: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// streamSource adapts a reader that cannot seek to Decoder.source.
+type streamSource struct {
+	io.Reader
+}
+
+// Seek implements io.Seeker, always failing.
+func (streamSource) Seek(int64, int) (int64, error) {
+	return 0, ErrNotSeekable
+}
+
+// Close closes the underlying reader when it is an io.Closer.
+func (s streamSource) Close() error {
+	if closer, ok := s.Reader.(io.Closer); ok {
+		return closer.Close() //nolint:wrapcheck // Wrapped by Decoder.Close.
+	}
+
+	return nil
+}
+
+// closeSource closes r if it is an io.Closer, for error paths that hand no
+// Decoder back to the caller.
+func closeSource(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
 // Decode reads a FLAC stream and decodes it to interleaved little-endian signed PCM bytes.
 // Native bit depth is preserved (16-bit FLAC produces s16le, 24-bit produces s24le, etc.).
-func Decode(rs io.ReadSeeker) ([]byte, PCMFormat, error) {
-	dec, err := NewDecoder(rs)
+// With DecoderOptions.VerifyMD5, a signature mismatch fails with ErrMD5Mismatch.
+func Decode(rs io.ReadSeeker, opts ...DecoderOptions) ([]byte, PCMFormat, error) {
+	dec, err := NewDecoder(rs, opts...)
 	if err != nil {
 		return nil, PCMFormat{}, err
 	}
@@ -17,81 +17,501 @@
 package flac
 
 import (
+	"cmp"
+	"crypto/md5" //nolint:gosec // FLAC mandates MD5 for its audio signature.
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"slices"
 
 	goflac "github.com/mewkiz/flac"
 	"github.com/mewkiz/flac/frame"
 	"github.com/mewkiz/flac/meta"
 )
 
-var errPCMLengthMismatch = errors.New("pcm length is not a multiple of frame size")
+var (
+	errPCMLengthMismatch = errors.New("pcm length is not a multiple of frame size")
+	errEncoderClosed     = errors.New("encoder is closed")
+)
 
 const (
-	defaultBlockSize = 4096
-	sign24Bit        = 0x800000
-	mask24Bit        = 0xFFFFFF
+	// defaultVendor is the VORBIS_COMMENT vendor string when the options set none.
+	defaultVendor = "saprobe-flac"
+
+	defaultBlockSize   = 4096
+	defaultMaxLPCOrder = 8
+	// StereoAdaptive repeats its full search about this often, as libFLAC does.
+	adaptiveStereoPeriod = 0.4 // seconds
+	sign24Bit            = 0x800000
+	mask24Bit            = 0xFFFFFF
 )
 
-// Encode writes interleaved little-endian signed PCM bytes as a FLAC stream to writer.
-// It is the inverse of Decode.
-func Encode(writer io.Writer, pcm []byte, format PCMFormat) error {
+// Encoder streams interleaved little-endian signed PCM into a FLAC stream.
+//
+// PCM written to the encoder is buffered until a full block is available, so
+// callers may write arbitrarily sized chunks, including chunks that split a
+// sample. Close flushes the final (possibly short) block.
+type Encoder struct {
+	writer io.Writer
+	sink   *frameSink
+	enc    *goflac.Encoder
+	info   meta.StreamInfo
+	format PCMFormat
+
+	nChannels int
+	frameSize int
+	blockSize int
+
+	planner    planner
+	stereoMode StereoMode
+	// StereoAdaptive state: the assignment in use and the frames left before the next search.
+	stereoChoice frame.Channels
+	stereoHold   int
+	stereoPeriod int
+
+	// Per-channel sample buffers, allocated at block size and reused across frames.
+	channels [][]int32
+	// Mid and side scratch for stereo decorrelation.
+	stereo stereoBuffers
+	// Partial block carried over between Write calls.
+	pending []byte
+
+	// Inter-channel samples encoded so far.
+	nSamples uint64
+	// Running MD5 of the encoded PCM.
+	md5 hash.Hash
+
+	// Seekable destinations get their STREAMINFO patched on Close.
+	seeker    io.WriteSeeker
+	streamPos int64
+	// Seek points resolved as frames are written; nil without a SEEKTABLE.
+	seekTable *seekRecorder
+	// Ogg encapsulation; nil for native FLAC.
+	ogg *oggMuxer
+
+	closed bool
+}
+
+// frameSink forwards encoded frames to the destination while counting bytes,
+// which lets the Encoder track frame sizes.
+type frameSink struct {
+	w io.Writer
+	n int64
+}
+
+func (s *frameSink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+
+	return n, err //nolint:wrapcheck // Transparent pass-through writer.
+}
+
+// NewEncoder writes a FLAC stream header to w and returns an Encoder accepting
+// interleaved little-endian signed PCM in the given format. Without options,
+// the encoder uses Level(DefaultLevel); only the first options value is used.
+//
+// The total sample count, frame sizes and audio MD5 are unknown up front. If w
+// is an io.WriteSeeker, Close rewrites STREAMINFO with the final values, and
+// fills in the SEEKTABLE requested by EncoderOptions.SeekTable; otherwise they
+// are left as "unknown" and placeholders, which the FLAC format allows.
+func NewEncoder(w io.Writer, format PCMFormat, opts ...EncoderOptions) (*Encoder, error) {
+	return newEncoder(w, format, resolveOptions(opts), nil)
+}
+
+// resolveOptions picks the caller's options or the default preset.
+func resolveOptions(opts []EncoderOptions) EncoderOptions {
+	if len(opts) == 0 {
+		return Level(DefaultLevel)
+	}
+
+	return opts[0]
+}
+
+// newEncoder is NewEncoder with the complete input optionally known up front,
+// letting the stream header carry the final sample count and MD5 even when the
+// destination cannot seek.
+func newEncoder(writer io.Writer, format PCMFormat, opts EncoderOptions, whole []byte) (*Encoder, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	nChannels := int(format.Channels) //nolint:gosec // Channels is 1-8, fits int.
-	bytesPerSample := format.BitDepth.BytesPerSample()
-	frameSize := nChannels * bytesPerSample
+	frameSize := nChannels * format.BitDepth.BytesPerSample()
 
-	if len(pcm)%frameSize != 0 {
-		return fmt.Errorf("%w: pcm=%d, frame=%d", errPCMLengthMismatch, len(pcm), frameSize)
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+
+	windows := opts.Apodization
+	if windows == nil {
+		windows = []Window{Tukey(defaultTukeyP)}
+	}
+
+	enc := &Encoder{
+		writer:    writer,
+		format:    format,
+		nChannels: nChannels,
+		frameSize: frameSize,
+		blockSize: blockSize,
+		md5:       md5.New(), //nolint:gosec // FLAC mandates MD5 for its audio signature.
+		planner: planner{
+			maxLPCOrder:       opts.MaxLPCOrder,
+			qlpPrecision:      opts.QLPPrecision,
+			precisionSearch:   opts.PrecisionSearch,
+			exhaustive:        opts.Exhaustive,
+			minPartitionOrder: opts.MinPartitionOrder,
+			maxPartitionOrder: opts.MaxPartitionOrder,
+			windows:           windows,
+		},
+		stereoMode:   opts.StereoMode,
+		stereoPeriod: max(1, int(float64(format.SampleRate)*adaptiveStereoPeriod/float64(blockSize)+0.5)),
+		info: meta.StreamInfo{
+			BlockSizeMin:  uint16(blockSize),         //nolint:gosec // blockSize <= 65535.
+			BlockSizeMax:  uint16(blockSize),         //nolint:gosec // blockSize <= 65535.
+			SampleRate:    uint32(format.SampleRate), //nolint:gosec // SampleRate is always positive and fits uint32.
+			NChannels:     uint8(nChannels),          //nolint:gosec // Channels is 1-8, fits uint8.
+			BitsPerSample: uint8(format.BitDepth),    //nolint:gosec // BitDepth is 4-32, fits uint8.
+		},
+	}
+
+	total := opts.SeekTable.TotalSamples
+
+	if whole != nil {
+		enc.info.NSamples = uint64(len(whole) / frameSize) //nolint:gosec // Length is never negative.
+		enc.info.MD5sum = md5.Sum(whole)                   //nolint:gosec // FLAC mandates MD5 for its audio signature.
+		total = enc.info.NSamples
+	}
+
+	if opts.SeekTable.enabled() {
+		if err := opts.SeekTable.validate(total); err != nil {
+			return nil, err
+		}
+
+		enc.seekTable = newSeekRecorder(opts.SeekTable.targets(format.SampleRate, total))
 	}
 
-	totalSamples := len(pcm) / frameSize
+	enc.seeker, enc.streamPos = probeSeeker(writer)
 
-	info := &meta.StreamInfo{
-		BlockSizeMin:  defaultBlockSize,
-		BlockSizeMax:  defaultBlockSize,
-		SampleRate:    uint32(format.SampleRate), //nolint:gosec // SampleRate is always positive and fits uint32.
-		NChannels:     uint8(nChannels),          //nolint:gosec // Channels is 1-8, fits uint8.
-		BitsPerSample: uint8(format.BitDepth),    //nolint:gosec // BitDepth is 4-32, fits uint8.
-		NSamples:      uint64(totalSamples),      //nolint:gosec // totalSamples is always positive.
+	padding := -1
+	if opts.Padding > 0 {
+		padding = opts.Padding
 	}
 
-	enc, err := goflac.NewEncoder(writer, info)
+	md := encoderMetadata(&enc.info, &opts)
+	if enc.seekTable != nil {
+		md.Blocks = slices.Insert(md.Blocks, 0, Block(enc.seekTable.table()))
+	}
+
+	header, err := appendMetadata(nil, md, padding)
 	if err != nil {
-		return fmt.Errorf("creating encoder: %w", err)
+		return nil, err
 	}
 
-	// Pre-allocate per-channel buffers at max block size; reused across frames.
-	channels := make([][]int32, nChannels)
-	for ch := range channels {
-		channels[ch] = make([]int32, defaultBlockSize)
+	if opts.Ogg.Enabled {
+		enc.ogg = newOggMuxer(writer, opts.Ogg)
+
+		if err := enc.ogg.writeHeader(header); err != nil {
+			return nil, err
+		}
+	} else if _, err := writer.Write(header); err != nil {
+		return nil, fmt.Errorf("writing stream header: %w", err)
+	}
+
+	// goflac.NewEncoder unconditionally emits its own signature and STREAMINFO;
+	// swallow them and only route frames to the destination.
+	enc.sink = &frameSink{w: io.Discard}
+
+	frameEnc, err := goflac.NewEncoder(enc.sink, &meta.StreamInfo{
+		BlockSizeMin:  enc.info.BlockSizeMin,
+		BlockSizeMax:  enc.info.BlockSizeMax,
+		SampleRate:    enc.info.SampleRate,
+		NChannels:     enc.info.NChannels,
+		BitsPerSample: enc.info.BitsPerSample,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating encoder: %w", err)
+	}
+
+	// Subframes arrive with their prediction already chosen by planSubframe.
+	frameEnc.EnablePredictionAnalysis(false)
+
+	// Ogg takes each frame whole, as one packet.
+	enc.sink.w = writer
+	if enc.ogg != nil {
+		enc.sink.w = &enc.ogg.packet
+	}
+
+	enc.sink.n = 0
+	enc.enc = frameEnc
+
+	enc.channels = make([][]int32, nChannels)
+	for ch := range enc.channels {
+		enc.channels[ch] = make([]int32, blockSize)
+	}
+
+	enc.pending = make([]byte, 0, blockSize*enc.frameSize)
+
+	return enc, nil
+}
+
+// probeSeeker returns w as an io.WriteSeeker and its current position, or nil
+// when it cannot seek. A writer that implements Seek may still be unseekable
+// (pipes, terminals): probing once avoids failing on Close.
+func probeSeeker(w io.Writer) (io.WriteSeeker, int64) {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			return ws, pos
+		}
+	}
+
+	return nil, 0
+}
+
+// encoderMetadata collects the metadata blocks requested by opts.
+func encoderMetadata(info *meta.StreamInfo, opts *EncoderOptions) *Metadata {
+	md := &Metadata{StreamInfo: streamInfoFromMeta(info)}
+
+	// The FLAC-in-Ogg mapping requires a VORBIS_COMMENT, as the first block
+	// after STREAMINFO.
+	if opts.Vendor != "" || len(opts.Tags) > 0 || opts.Ogg.Enabled {
+		md.Blocks = append(md.Blocks, &VorbisComment{Vendor: cmp.Or(opts.Vendor, defaultVendor), Tags: opts.Tags})
+	}
+
+	if opts.CueSheet != nil {
+		md.Blocks = append(md.Blocks, opts.CueSheet)
+	}
+
+	for _, picture := range opts.Pictures {
+		md.Blocks = append(md.Blocks, picture)
+	}
+
+	return md
+}
+
+// Write encodes interleaved little-endian signed PCM bytes. Partial blocks are
+// buffered until enough data arrives or Close is called.
+func (e *Encoder) Write(pcm []byte) (int, error) {
+	if e.closed {
+		return 0, errEncoderClosed
+	}
+
+	blockBytes := e.blockSize * e.frameSize
+	written := 0
+
+	for len(pcm) > 0 {
+		// Fast path: encode whole blocks straight from the caller's buffer.
+		if len(e.pending) == 0 && len(pcm) >= blockBytes {
+			if err := e.encodeBlock(pcm[:blockBytes], e.blockSize); err != nil {
+				return written, err
+			}
+
+			pcm = pcm[blockBytes:]
+			written += blockBytes
+
+			continue
+		}
+
+		n := min(len(pcm), blockBytes-len(e.pending))
+		e.pending = append(e.pending, pcm[:n]...)
+		pcm = pcm[n:]
+		written += n
+
+		if len(e.pending) == blockBytes {
+			if err := e.encodeBlock(e.pending, e.blockSize); err != nil {
+				return written, err
+			}
+
+			e.pending = e.pending[:0]
+		}
+	}
+
+	return written, nil
+}
+
+// Close flushes the final block and, for seekable destinations, rewrites
+// STREAMINFO with the total sample count, frame sizes and audio MD5, and the
+// SEEKTABLE with frame offsets. It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+
+	e.closed = true
+
+	if len(e.pending)%e.frameSize != 0 {
+		return fmt.Errorf("%w: trailing %d bytes, frame=%d",
+			errPCMLengthMismatch, len(e.pending)%e.frameSize, e.frameSize)
+	}
+
+	if len(e.pending) > 0 {
+		if err := e.encodeBlock(e.pending, len(e.pending)/e.frameSize); err != nil {
+			return err
+		}
+
+		e.pending = e.pending[:0]
+	}
+
+	if e.ogg != nil {
+		if err := e.ogg.close(e.nSamples); err != nil {
+			return err
+		}
+	}
+
+	if e.seeker == nil {
+		return nil
+	}
+
+	return e.patchHeader()
+}
+
+// encodeBlock encodes blockSamples inter-channel samples from pcm as one frame.
+func (e *Encoder) encodeBlock(pcm []byte, blockSamples int) error {
+	// The FLAC signature hashes samples as little-endian signed integers of
+	// ceil(bps/8) bytes, which is exactly our PCM layout.
+	e.md5.Write(pcm)
+
+	deinterleave(e.channels, pcm, 0, blockSamples, e.nChannels, e.format.BitDepth)
+
+	f := e.buildFrame(blockSamples)
+
+	before := e.sink.n
+	if e.seekTable != nil {
+		e.seekTable.frame(e.nSamples, uint64(before), blockSamples) //nolint:gosec // Byte counts are never negative.
+	}
+
+	if err := e.enc.WriteFrame(f); err != nil {
+		return fmt.Errorf("writing frame: %w", err)
+	}
+
+	frameBytes := uint32(e.sink.n - before) //nolint:gosec // Frame sizes are far below 4 GiB.
+	if e.info.FrameSizeMin == 0 || frameBytes < e.info.FrameSizeMin {
+		e.info.FrameSizeMin = frameBytes
+	}
+
+	e.info.FrameSizeMax = max(e.info.FrameSizeMax, frameBytes)
+	e.nSamples += uint64(blockSamples) //nolint:gosec // blockSamples is always positive.
+
+	if e.ogg != nil {
+		return e.ogg.writeFrame(e.nSamples)
+	}
+
+	return nil
+}
+
+// patchHeader rewrites the STREAMINFO body, and the SEEKTABLE body that
+// follows it when present, in place and restores the write position.
+func (e *Encoder) patchHeader() error {
+	e.info.NSamples = e.nSamples
+	copy(e.info.MD5sum[:], e.md5.Sum(nil))
+
+	end, err := e.seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("patching stream header: %w", err)
 	}
 
-	remaining := totalSamples
-	offset := 0
+	if e.ogg != nil {
+		// STREAMINFO sits on the first page, whose checksum covers it.
+		if _, err = e.seeker.Seek(e.streamPos, io.SeekStart); err != nil {
+			return fmt.Errorf("patching stream header: %w", err)
+		}
 
-	for remaining > 0 {
-		blockSamples := min(remaining, defaultBlockSize)
+		if _, err = e.seeker.Write(e.ogg.firstPage(appendStreamInfoBody(nil, &e.info))); err != nil {
+			return fmt.Errorf("patching stream header: %w", err)
+		}
+	} else {
+		if _, err = e.seeker.Seek(e.streamPos+signatureSize+blockHeaderSize, io.SeekStart); err != nil {
+			return fmt.Errorf("patching stream header: %w", err)
+		}
 
-		deinterleave(channels, pcm, offset, blockSamples, nChannels, format.BitDepth)
-		offset += blockSamples * frameSize
-		remaining -= blockSamples
+		if _, err = e.seeker.Write(appendStreamInfoBody(nil, &e.info)); err != nil {
+			return fmt.Errorf("patching stream header: %w", err)
+		}
+	}
 
-		f := buildFrame(channels, blockSamples, format)
+	if e.seekTable != nil {
+		// Skip the SEEKTABLE block header: its length and last flag are unchanged.
+		if _, err = e.seeker.Seek(blockHeaderSize, io.SeekCurrent); err != nil {
+			return fmt.Errorf("patching stream header: %w", err)
+		}
 
-		if err := enc.WriteFrame(f); err != nil {
-			return fmt.Errorf("writing frame: %w", err)
+		if _, err = e.seeker.Write(e.seekTable.table().appendBody(nil)); err != nil {
+			return fmt.Errorf("patching stream header: %w", err)
 		}
 	}
 
+	if _, err = e.seeker.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("patching stream header: %w", err)
+	}
+
+	return nil
+}
+
+// Encode writes interleaved little-endian signed PCM bytes as a FLAC stream to writer.
+// It is the inverse of Decode. Options behave as for NewEncoder, except that a
+// requested SEEKTABLE is always filled in: when writer cannot seek, the stream
+// is staged in memory first.
+func Encode(writer io.Writer, pcm []byte, format PCMFormat, opts ...EncoderOptions) error {
+	frameSize := int(format.Channels) * format.BitDepth.BytesPerSample() //nolint:gosec // Channels is 1-8, fits int.
+
+	if len(pcm)%frameSize != 0 {
+		return fmt.Errorf("%w: pcm=%d, frame=%d", errPCMLengthMismatch, len(pcm), frameSize)
+	}
+
+	options := resolveOptions(opts)
+
+	dst := writer
+
+	// Frame offsets are only known once the audio is encoded: stage the stream
+	// in memory so its SEEKTABLE can be filled in even when writer cannot seek.
+	var staged *seekBuffer
+	if ws, _ := probeSeeker(writer); ws == nil && options.SeekTable.enabled() {
+		staged = &seekBuffer{}
+		dst = staged
+	}
+
+	enc, err := newEncoder(dst, format, options, pcm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := enc.Write(pcm); err != nil {
+		return err
+	}
+
 	if err := enc.Close(); err != nil {
-		return fmt.Errorf("closing encoder: %w", err)
+		return err
+	}
+
+	if staged != nil {
+		if _, err := writer.Write(staged.buf); err != nil {
+			return fmt.Errorf("writing stream: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// planStereo runs the stereo search, or under StereoAdaptive reuses the last
+// search's assignment until its period elapses.
+func (e *Encoder) planStereo(left, right []int32, bps uint) (frame.Channels, [2]subframePlan) {
+	if e.stereoMode == StereoAdaptive && e.stereoHold > 0 {
+		e.stereoHold--
+
+		if plans, ok := e.planner.planAssignment(e.stereoChoice, left, right, bps, &e.stereo); ok {
+			return e.stereoChoice, plans
+		}
+	}
+
+	assignment, plans := e.planner.planStereo(left, right, bps, &e.stereo)
+	e.stereoChoice = assignment
+	e.stereoHold = e.stereoPeriod - 1
+
+	return assignment, plans
+}
+
 // deinterleave reads interleaved little-endian signed PCM bytes into pre-allocated
 // per-channel int32 slices. It is the inverse of interleave in decode.go.
 //
@@ -147,26 +567,42 @@ func deinterleave(channels [][]int32, pcm []byte, offset, blockSize, nChannels i
 	}
 }
 
-// buildFrame constructs a FLAC frame from per-channel int32 samples.
-func buildFrame(channels [][]int32, blockSize int, format PCMFormat) *frame.Frame {
+// buildFrame constructs a FLAC frame from the deinterleaved channel buffers,
+// choosing the cheapest prediction method for each subframe.
+func (e *Encoder) buildFrame(blockSize int) *frame.Frame {
+	channels := e.channels
+	format := e.format
 	nChannels := len(channels)
 	chanAssignment := frame.Channels(nChannels - 1) //nolint:gosec // nChannels is 1-8, always >= 1.
+	bps := uint(format.BitDepth)
+
+	plans := make([]subframePlan, nChannels)
+	if nChannels == 2 && e.stereoMode != StereoIndependent {
+		var stereoPlans [2]subframePlan
+
+		chanAssignment, stereoPlans = e.planStereo(channels[0], channels[1], bps)
+		copy(plans, stereoPlans[:])
+	} else {
+		for ch := range nChannels {
+			plans[ch] = e.planner.plan(channels[ch], bps)
+		}
+	}
 
+	// Subframes carry the left/right samples: goflac decorrelates them in place
+	// according to the channel assignment before writing.
 	subframes := make([]*frame.Subframe, nChannels)
 	for ch := range nChannels {
 		subframes[ch] = &frame.Subframe{
-			SubHeader: frame.SubHeader{
-				Pred: frame.PredVerbatim,
-			},
-			Samples:  channels[ch],
-			NSamples: blockSize,
+			SubHeader: plans[ch].header,
+			Samples:   channels[ch],
+			NSamples:  blockSize,
 		}
 	}
 
 	return &frame.Frame{
 		Header: frame.Header{
 			HasFixedBlockSize: true,
-			BlockSize:         uint16(blockSize),         //nolint:gosec // blockSize <= 4096, fits uint16.
+			BlockSize:         uint16(blockSize),         //nolint:gosec // blockSize <= 65535.
 			SampleRate:        uint32(format.SampleRate), //nolint:gosec // SampleRate is always positive.
 			Channels:          chanAssignment,
 			BitsPerSample:     uint8(format.BitDepth), //nolint:gosec // BitDepth is 4-32, fits uint8.
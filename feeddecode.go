@@ -0,0 +1,434 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"crypto/md5" //nolint:gosec // FLAC mandates MD5 for its audio signature.
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+
+	goflac "github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+)
+
+// ErrNeedMoreData is returned by FeedDecoder.NextFrame when the bytes written
+// so far end before the next frame does.
+var ErrNeedMoreData = errors.New("need more data")
+
+// errFrameTruncated is returned to goflac when a frame reads past the next
+// frame header, which means that header was a false sync inside the frame.
+var errFrameTruncated = errors.New("frame runs past the next frame header")
+
+// Frame is one decoded FLAC frame.
+type Frame struct {
+	// Sample is the stream position of the first sample of the frame.
+	Sample uint64
+	// PCM holds the frame's samples, interleaved in the decoder's Format. It is
+	// overwritten by the next call to NextFrame.
+	PCM []byte
+}
+
+// FeedDecoder decodes a FLAC stream pushed to it in chunks of any size, for
+// callers that receive bytes as they arrive and cannot block on an io.Reader.
+// Write buffers input; NextFrame decodes one frame at a time, or reports
+// ErrNeedMoreData until the frame is complete. Read input is dropped as more
+// is written, so memory stays bounded by a few frames when NextFrame is
+// drained after every Write.
+type FeedDecoder struct {
+	feed   frameFeed
+	header *streamHeader
+	stream *goflac.Stream
+	format PCMFormat
+
+	// Header of the frame at the start of the feed, once parsed.
+	current    frameHeader
+	hasCurrent bool
+	// Offset at which the search for the next frame header resumes.
+	scan int
+
+	verifyMD5 bool
+	md5       hash.Hash
+	sample    uint64
+	pcm       []byte
+	closed    bool
+	eof       bool
+	// Sticky failure returned by every later NextFrame.
+	err error
+}
+
+// frameFeed buffers the input and hands goflac the bytes of the frame being
+// decoded, and no more.
+type frameFeed struct {
+	// mem holds the input and buf its unread part, from off on. Read bytes are
+	// dropped by the next write that would grow mem, or finds half of it read,
+	// so draining a large write frame by frame moves no memory.
+	mem []byte
+	off int
+	buf []byte
+	// Bytes of buf already read by goflac, and the end of the current frame.
+	given, limit int
+}
+
+// Read implements io.Reader over buf[given:limit].
+func (f *frameFeed) Read(p []byte) (int, error) {
+	if f.given == f.limit {
+		return 0, errFrameTruncated
+	}
+
+	n := copy(p, f.buf[f.given:f.limit])
+	f.given += n
+
+	return n, nil
+}
+
+// write appends p to the buffer.
+func (f *frameFeed) write(p []byte) {
+	if f.off > 0 && (len(f.mem)+len(p) > cap(f.mem) || f.off > len(f.mem)/2) {
+		f.mem = f.mem[:copy(f.mem, f.buf)]
+		f.off = 0
+	}
+
+	f.mem = append(f.mem, p...)
+	f.buf = f.mem[f.off:]
+}
+
+// consume drops the first n unread bytes.
+func (f *frameFeed) consume(n int) {
+	f.off += n
+	f.buf = f.mem[f.off:]
+	f.given, f.limit = 0, 0
+}
+
+// NewFeedDecoder returns a decoder waiting for its first Write. A frame is
+// known to be complete only once the header of the next one has been written,
+// so decoded audio lags the input by a frame, and the last frame decodes after
+// Close. Only the first options value is used, and only its VerifyMD5.
+func NewFeedDecoder(opts ...DecoderOptions) *FeedDecoder {
+	dec := &FeedDecoder{}
+	if len(opts) > 0 {
+		dec.verifyMD5 = opts[0].VerifyMD5
+	}
+
+	return dec
+}
+
+// Write buffers p for NextFrame. It never blocks and always accepts all of p,
+// unless the decoder is closed.
+func (d *FeedDecoder) Write(p []byte) (int, error) {
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	d.feed.write(p)
+
+	return len(p), nil
+}
+
+// Close marks the end of the input: NextFrame decodes what is left, then
+// returns io.EOF.
+func (d *FeedDecoder) Close() error {
+	d.closed = true
+
+	return nil
+}
+
+// Metadata returns the stream's metadata blocks, or nil until they have been
+// written in full and NextFrame called. The returned value is shared with the
+// decoder and must not be modified.
+func (d *FeedDecoder) Metadata() *Metadata {
+	if d.header == nil {
+		return nil
+	}
+
+	return d.header.metadata
+}
+
+// Format returns the PCM output format, zero until Metadata is available.
+func (d *FeedDecoder) Format() PCMFormat { return d.format }
+
+// NextFrame decodes the next frame. It returns ErrNeedMoreData when the input
+// written so far does not hold it in full, in which case the partial frame is
+// kept for the next call, and io.EOF once the input is closed and drained.
+// With DecoderOptions.VerifyMD5, the final call fails with ErrMD5Mismatch
+// instead when the audio does not match the stream's signature.
+func (d *FeedDecoder) NextFrame() (Frame, error) {
+	if d.err != nil {
+		return Frame{}, d.err
+	}
+
+	if d.eof {
+		return Frame{}, io.EOF
+	}
+
+	if d.header == nil {
+		if err := d.readHeader(); err != nil {
+			return Frame{}, d.fail(err)
+		}
+	}
+
+	audioFrame, end, err := d.parseFrame()
+	if err != nil {
+		return Frame{}, d.fail(err)
+	}
+
+	if end == 0 {
+		d.eof = true
+
+		if err := d.verify(); err != nil {
+			return Frame{}, err
+		}
+
+		return Frame{}, io.EOF
+	}
+
+	blockSize := int(audioFrame.BlockSize)
+	nChannels := int(d.format.Channels) //nolint:gosec // At most 8 channels.
+
+	frameBytes := blockSize * nChannels * d.format.BitDepth.BytesPerSample()
+	if cap(d.pcm) < frameBytes {
+		d.pcm = make([]byte, frameBytes)
+	} else {
+		d.pcm = d.pcm[:frameBytes]
+	}
+
+	interleave(d.pcm, audioFrame.Subframes, blockSize, nChannels, d.format.BitDepth)
+
+	if d.md5 != nil {
+		d.md5.Write(d.pcm)
+	}
+
+	decoded := Frame{Sample: d.sample, PCM: d.pcm}
+	d.sample += uint64(blockSize) //nolint:gosec // Block sizes are positive.
+
+	d.feed.consume(end)
+	d.hasCurrent = false
+	d.scan = 0
+
+	return decoded, nil
+}
+
+// parseFrame decodes the frame at the start of the feed and returns it with
+// its length, which is 0 at the end of the stream. A frame reading past the
+// next header found by frameEnd shows that header to be a false sync inside
+// the frame: the search resumes past it, on a fresh goflac stream since the
+// failed read leaves its bit reader mid-frame. Bytes left after the last frame
+// of the closed input, such as an ID3v1 tag, are dropped with it.
+func (d *FeedDecoder) parseFrame() (*frame.Frame, int, error) {
+	for {
+		end, err := d.frameEnd()
+		if err != nil || end == 0 {
+			return nil, end, err
+		}
+
+		d.feed.given, d.feed.limit = 0, end
+		audioFrame, err := d.stream.ParseNext()
+
+		switch {
+		case errors.Is(err, errFrameTruncated) && end < len(d.feed.buf):
+			if d.stream, err = openFrames(framePreamble(d.header.info), &d.feed); err != nil {
+				return nil, 0, fmt.Errorf("%w: %w", ErrReadFailure, err)
+			}
+
+			d.scan = end + 1
+		case errors.Is(err, errFrameTruncated):
+			return nil, 0, fmt.Errorf("%w: frame at sample %d: %w", ErrReadFailure, d.sample, io.ErrUnexpectedEOF)
+		case err != nil:
+			return nil, 0, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		case d.feed.given != end && end < len(d.feed.buf):
+			return nil, 0, fmt.Errorf("%w: frame ends %d bytes before the next frame header",
+				ErrReadFailure, end-d.feed.given)
+		default:
+			return audioFrame, end, nil
+		}
+	}
+}
+
+// fail records err as sticky unless more data may resolve it.
+func (d *FeedDecoder) fail(err error) error {
+	if !errors.Is(err, ErrNeedMoreData) {
+		d.err = err
+	}
+
+	return err
+}
+
+// readHeader parses the metadata once it is buffered in full, and opens goflac
+// on the frames that follow.
+func (d *FeedDecoder) readHeader() error {
+	size, err := streamHeaderSize(d.feed.buf)
+	if errors.Is(err, ErrNeedMoreData) && d.closed {
+		err = io.ErrUnexpectedEOF
+	}
+
+	switch {
+	case errors.Is(err, ErrNeedMoreData):
+		return err
+	case err != nil:
+		return fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	header, err := readStreamHeader(bytes.NewReader(d.feed.buf[:size]))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	bitDepth := BitDepth(header.info.BitsPerSample)
+	if !slices.Contains(flacBitDepths, bitDepth) {
+		return ErrBitDepth
+	}
+
+	stream, err := openFrames(framePreamble(header.info), &d.feed)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	d.feed.consume(size)
+	d.header, d.stream = header, stream
+	d.format = PCMFormat{
+		SampleRate: int(header.info.SampleRate),
+		BitDepth:   bitDepth,
+		Channels:   uint(header.info.NChannels),
+	}
+
+	if d.verifyMD5 && header.info.MD5sum != [md5.Size]byte{} {
+		d.md5 = md5.New() //nolint:gosec // FLAC mandates MD5 for its audio signature.
+	}
+
+	return nil
+}
+
+// frameEnd returns the length of the frame at the start of the feed: up to the
+// next header continuing its sample numbering, or to the end of the closed
+// input. It returns 0 at the end of the stream.
+func (d *FeedDecoder) frameEnd() (int, error) {
+	buf, info := d.feed.buf, d.header.info
+
+	if !d.hasCurrent {
+		if len(buf) == 0 && d.closed {
+			return 0, nil
+		}
+
+		if len(buf) < maxFrameHeaderSize && !d.closed {
+			return 0, ErrNeedMoreData
+		}
+
+		hdr, ok := parseFrameHeader(buf[:min(maxFrameHeaderSize, len(buf))], info)
+		if !ok {
+			return 0, fmt.Errorf("%w: no frame header at sample %d", ErrReadFailure, d.sample)
+		}
+
+		d.current, d.hasCurrent, d.scan = hdr, true, hdr.size
+	}
+
+	next := d.current.sampleNum + uint64(d.current.blockSize) //nolint:gosec // Block sizes are positive.
+
+	// Headers straddling the end of buf are retried once more data arrives.
+	limit := len(buf) - maxFrameHeaderSize
+	if d.closed {
+		limit = len(buf)
+	}
+
+	for ; d.scan < limit; d.scan++ {
+		if buf[d.scan] != frameSyncByte {
+			continue
+		}
+
+		hdr, ok := parseFrameHeader(buf[d.scan:min(d.scan+maxFrameHeaderSize, len(buf))], info)
+		if ok && hdr.sampleNum == next && hdr.variable == d.current.variable {
+			return d.scan, nil
+		}
+	}
+
+	switch {
+	case d.closed:
+		// The last frame runs to the end of the input.
+		return len(buf), nil
+	case d.scan > maxSyncDistance:
+		return 0, fmt.Errorf("%w: frame at sample %d exceeds %d bytes", ErrReadFailure, d.sample, maxSyncDistance)
+	default:
+		return 0, ErrNeedMoreData
+	}
+}
+
+// verify compares the running hash with the STREAMINFO signature once the
+// stream is exhausted.
+func (d *FeedDecoder) verify() error {
+	if d.md5 == nil {
+		return nil
+	}
+
+	if got := d.md5.Sum(nil); !bytes.Equal(got, d.header.info.MD5sum[:]) {
+		d.err = fmt.Errorf("%w: decoded %x, stream info %x", ErrMD5Mismatch, got, d.header.info.MD5sum)
+	}
+
+	d.md5 = nil
+
+	return d.err
+}
+
+// streamHeaderSize returns the length of the metadata section at the start of
+// buf, a leading ID3v2 tag included, walking only block headers so it stays
+// cheap to retry after every Write. It returns ErrNeedMoreData when buf ends
+// within the section.
+func streamHeaderSize(buf []byte) (int, error) {
+	pos := 0
+
+	if len(buf) >= len(id3Signature) && bytes.Equal(buf[:len(id3Signature)], id3Signature) {
+		if len(buf) < id3HeaderSize {
+			return 0, ErrNeedMoreData
+		}
+
+		// The size is a synchsafe integer: 7 bits per byte.
+		pos = id3HeaderSize + (int(buf[6])<<21 | int(buf[7])<<14 | int(buf[8])<<7 | int(buf[9]))
+		if buf[5]&id3FooterFlag != 0 {
+			pos += id3HeaderSize
+		}
+	}
+
+	if len(buf) < pos+signatureSize {
+		return 0, ErrNeedMoreData
+	}
+
+	if sig := buf[pos : pos+signatureSize]; !bytes.Equal(sig, flacSignature) {
+		return 0, fmt.Errorf("%w: %q", errSignature, sig)
+	}
+
+	pos += signatureSize
+
+	for {
+		if len(buf) < pos+blockHeaderSize {
+			return 0, ErrNeedMoreData
+		}
+
+		hdr := buf[pos : pos+blockHeaderSize]
+		pos += blockHeaderSize + (int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3]))
+
+		if hdr[0]&0x80 != 0 {
+			break
+		}
+	}
+
+	if len(buf) < pos {
+		return 0, ErrNeedMoreData
+	}
+
+	return pos, nil
+}
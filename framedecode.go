@@ -0,0 +1,161 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+var (
+	// ErrNoFrameHeader is returned by NewFrameDecoder when no valid frame
+	// header is found within maxSyncDistance bytes.
+	ErrNoFrameHeader = errors.New("no frame header found")
+
+	// ErrStreamParams is returned by NewFrameDecoder when StreamInfoParams are
+	// invalid, or leave a parameter unknown that the first frame header does
+	// not code either.
+	ErrStreamParams = errors.New("invalid stream parameters")
+)
+
+const (
+	// maxSyncDistance bounds the bytes NewFrameDecoder skips looking for a
+	// frame: twice the largest frame of the widest stream stored verbatim.
+	maxSyncDistance = (MaxBlockSize + 1) * maxChannels * 4 * 2
+	// maxChannels and maxSampleRate are the limits of the STREAMINFO fields.
+	maxChannels   = 8
+	maxSampleRate = 1<<20 - 1
+)
+
+// StreamInfoParams stand in for STREAMINFO when decoding headerless frames.
+// Zero fields are taken from the first frame header, which usually codes
+// them; TotalSamples stays unknown when zero.
+type StreamInfoParams struct {
+	SampleRate   int
+	Channels     uint
+	BitDepth     BitDepth
+	TotalSamples uint64
+}
+
+// NewFrameDecoder returns a streaming decoder for raw FLAC frames without the
+// fLaC signature and metadata, as carried by containers or network captures.
+// It skips bytes up to the first valid frame header (sync code, consistent
+// fields and CRC-8) and decodes from there. The decoder cannot seek, and its
+// Metadata holds only the resulting StreamInfo. The caller should call Close
+// when done.
+func NewFrameDecoder(r io.Reader, params StreamInfoParams) (*Decoder, error) {
+	if err := params.validate(); err != nil {
+		closeSource(r)
+
+		return nil, err
+	}
+
+	info := &meta.StreamInfo{
+		SampleRate:    uint32(params.SampleRate), //nolint:gosec // Validated.
+		NChannels:     uint8(params.Channels),    //nolint:gosec // Validated.
+		BitsPerSample: uint8(params.BitDepth),    //nolint:gosec // Validated.
+		NSamples:      params.TotalSamples,
+	}
+
+	buf, hdr, err := syncFrame(r, info)
+	if err != nil {
+		closeSource(r)
+
+		return nil, err
+	}
+
+	info.SampleRate = cmp.Or(info.SampleRate, hdr.sampleRate)
+	info.NChannels = cmp.Or(info.NChannels, uint8(hdr.channels)) //nolint:gosec // At most 8 channels.
+	info.BitsPerSample = cmp.Or(info.BitsPerSample, hdr.bitDepth)
+
+	if info.SampleRate == 0 || info.BitsPerSample == 0 {
+		closeSource(r)
+
+		return nil, fmt.Errorf("%w: frame header defers sample rate or bit depth to STREAMINFO", ErrStreamParams)
+	}
+
+	// Later frames may be of any size.
+	info.BlockSizeMin, info.BlockSizeMax = MinBlockSize, MaxBlockSize
+
+	header := &streamHeader{info: info, metadata: &Metadata{StreamInfo: streamInfoFromMeta(info)}}
+
+	return newDecoder(streamSource{r}, io.MultiReader(bytes.NewReader(buf), r), header, -1, nil)
+}
+
+// validate checks the parameters that are set.
+func (p *StreamInfoParams) validate() error {
+	switch {
+	case p.SampleRate < 0 || p.SampleRate > maxSampleRate:
+		return fmt.Errorf("%w: sample rate %d", ErrStreamParams, p.SampleRate)
+	case p.Channels > maxChannels:
+		return fmt.Errorf("%w: %d channels", ErrStreamParams, p.Channels)
+	case p.BitDepth != 0 && !slices.Contains(flacBitDepths, p.BitDepth):
+		return fmt.Errorf("%w: bit depth %d", ErrStreamParams, p.BitDepth)
+	}
+
+	return nil
+}
+
+// syncFrame reads r up to the first frame header agreeing with info, and
+// returns the bytes read from that header on along with the parsed header.
+func syncFrame(r io.Reader, info *meta.StreamInfo) ([]byte, frameHeader, error) {
+	var (
+		buf  []byte
+		from int
+		eof  bool
+	)
+
+	for {
+		// Headers straddling the end of buf are retried once more data arrives.
+		limit := len(buf) - maxFrameHeaderSize
+		if eof {
+			limit = len(buf)
+		}
+
+		for ; from < limit; from++ {
+			if buf[from] != frameSyncByte {
+				continue
+			}
+
+			if hdr, ok := parseFrameHeader(buf[from:min(from+maxFrameHeaderSize, len(buf))], info); ok {
+				return buf[from:], hdr, nil
+			}
+		}
+
+		if eof || from > maxSyncDistance {
+			return nil, frameHeader{}, ErrNoFrameHeader
+		}
+
+		chunk := make([]byte, scanChunkSize)
+
+		n, err := io.ReadFull(r, chunk)
+		buf = append(buf, chunk[:n]...)
+
+		switch {
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			eof = true
+		case err != nil:
+			return nil, frameHeader{}, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import "github.com/mewkiz/flac/meta"
+
+const (
+	// maxFrameHeaderSize bounds a frame header: 4 fixed bytes, up to 7 bytes of
+	// coded number, 2 bytes of block size, 2 bytes of sample rate and the CRC-8.
+	maxFrameHeaderSize = 4 + 7 + 2 + 2 + 1
+
+	frameSyncByte = 0xFF
+	// The second byte carries the rest of the 14-bit sync code, a reserved zero
+	// bit and the blocking strategy bit.
+	frameSyncMask = 0xFE
+	frameSyncLow  = 0xF8
+
+	crc8Poly = 0x07
+)
+
+// frameHeader holds the frame header fields needed to locate audio in a stream.
+type frameHeader struct {
+	// First inter-channel sample of the frame.
+	sampleNum uint64
+	blockSize int
+	// Variable block-size streams code sample numbers, fixed ones frame numbers.
+	variable bool
+	// Header length in bytes, CRC-8 included.
+	size int
+	// Stream parameters coded in the header; rate and depth are 0 when they
+	// defer to STREAMINFO.
+	sampleRate uint32
+	channels   int
+	bitDepth   uint8
+}
+
+//nolint:gochecknoglobals
+var crc8Table = makeCRC8Table()
+
+func makeCRC8Table() [256]byte {
+	var table [256]byte
+
+	for i := range table {
+		crc := byte(i) //nolint:gosec // i < 256.
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ crc8Poly
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}
+
+// crc8 computes the frame header checksum (polynomial x^8 + x^2 + x + 1).
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc = crc8Table[crc^b]
+	}
+
+	return crc
+}
+
+// parseFrameHeader decodes the frame header at the start of buf, which must
+// hold maxFrameHeaderSize bytes unless the stream ends sooner. It reports
+// false unless the header is well formed, its CRC-8 matches and it agrees with
+// info, which keeps false syncs inside audio data rare.
+func parseFrameHeader(buf []byte, info *meta.StreamInfo) (frameHeader, bool) {
+	const fixedFields = 4
+
+	if len(buf) < fixedFields+1 || buf[0] != frameSyncByte || buf[1]&frameSyncMask != frameSyncLow {
+		return frameHeader{}, false
+	}
+
+	hdr := frameHeader{variable: buf[1]&1 != 0}
+	blockCode, rateCode := buf[2]>>4, buf[2]&0x0F
+	channelCode, depthCode := buf[3]>>4, buf[3]>>1&0x07
+
+	// Reserved block size, invalid sample rate, reserved channel assignment,
+	// reserved sample size and reserved bit.
+	if blockCode == 0 || rateCode == 0x0F || channelCode > 10 || depthCode == 3 || buf[3]&1 != 0 {
+		return frameHeader{}, false
+	}
+
+	if !channelsMatch(channelCode, info) || !depthMatches(depthCode, info) {
+		return frameHeader{}, false
+	}
+
+	num, pos, ok := readCodedNumber(buf, fixedFields, hdr.variable)
+	if !ok {
+		return frameHeader{}, false
+	}
+
+	switch {
+	case blockCode == 1:
+		hdr.blockSize = 192
+	case blockCode <= 5:
+		hdr.blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		if pos+1 > len(buf) {
+			return frameHeader{}, false
+		}
+
+		hdr.blockSize = int(buf[pos]) + 1
+		pos++
+	case blockCode == 7:
+		if pos+2 > len(buf) {
+			return frameHeader{}, false
+		}
+
+		hdr.blockSize = (int(buf[pos])<<8 | int(buf[pos+1])) + 1
+		pos += 2
+	default:
+		hdr.blockSize = 256 << (blockCode - 8)
+	}
+
+	if info.BlockSizeMax != 0 && hdr.blockSize > int(info.BlockSizeMax) {
+		return frameHeader{}, false
+	}
+
+	rate, pos, ok := readSampleRate(buf, pos, rateCode)
+	if !ok || rate != 0 && info.SampleRate != 0 && rate != info.SampleRate {
+		return frameHeader{}, false
+	}
+
+	if pos+1 > len(buf) || crc8(buf[:pos]) != buf[pos] {
+		return frameHeader{}, false
+	}
+
+	hdr.size = pos + 1
+	hdr.sampleNum = num
+	hdr.sampleRate = rate
+	hdr.channels = channelCount(channelCode)
+	hdr.bitDepth = codedDepth(depthCode)
+
+	if !hdr.variable {
+		// Fixed block-size streams number frames; every frame but the last holds
+		// the stream's block size.
+		fixed := uint64(info.BlockSizeMin)
+		if fixed == 0 {
+			fixed = uint64(hdr.blockSize) //nolint:gosec // Block sizes are positive.
+		}
+
+		hdr.sampleNum = num * fixed
+	}
+
+	return hdr, true
+}
+
+// readCodedNumber decodes the UTF-8-like coded frame or sample number at pos.
+// Frame numbers take at most 6 bytes (31 bits), sample numbers 7 (36 bits).
+func readCodedNumber(buf []byte, pos int, variable bool) (uint64, int, bool) {
+	if pos >= len(buf) {
+		return 0, pos, false
+	}
+
+	first := buf[pos]
+
+	var (
+		extra int
+		num   uint64
+	)
+
+	switch {
+	case first&0x80 == 0:
+		return uint64(first), pos + 1, true
+	case first&0xE0 == 0xC0:
+		extra, num = 1, uint64(first&0x1F)
+	case first&0xF0 == 0xE0:
+		extra, num = 2, uint64(first&0x0F)
+	case first&0xF8 == 0xF0:
+		extra, num = 3, uint64(first&0x07)
+	case first&0xFC == 0xF8:
+		extra, num = 4, uint64(first&0x03)
+	case first&0xFE == 0xFC:
+		extra, num = 5, uint64(first&0x01)
+	case first == 0xFE && variable:
+		extra, num = 6, 0
+	default:
+		return 0, pos, false
+	}
+
+	if pos+1+extra > len(buf) {
+		return 0, pos, false
+	}
+
+	for _, b := range buf[pos+1 : pos+1+extra] {
+		if b&0xC0 != 0x80 {
+			return 0, pos, false
+		}
+
+		num = num<<6 | uint64(b&0x3F)
+	}
+
+	return num, pos + 1 + extra, true
+}
+
+// readSampleRate decodes the sample rate code and any trailing rate field,
+// returning 0 when the rate defers to STREAMINFO.
+func readSampleRate(buf []byte, pos int, code byte) (uint32, int, bool) {
+	rates := [...]uint32{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}
+
+	switch code {
+	case 12:
+		if pos+1 > len(buf) {
+			return 0, pos, false
+		}
+
+		return uint32(buf[pos]) * 1000, pos + 1, true
+	case 13, 14:
+		if pos+2 > len(buf) {
+			return 0, pos, false
+		}
+
+		rate := uint32(buf[pos])<<8 | uint32(buf[pos+1])
+		if code == 14 {
+			rate *= 10
+		}
+
+		return rate, pos + 2, true
+	default:
+		return rates[code], pos, true
+	}
+}
+
+// channelCount returns the number of channels of a channel assignment code.
+func channelCount(code byte) int {
+	if code > 7 {
+		// Left/side, side/right and mid/side are all stereo.
+		return 2
+	}
+
+	return int(code) + 1
+}
+
+// channelsMatch reports whether a channel assignment code agrees with STREAMINFO.
+func channelsMatch(code byte, info *meta.StreamInfo) bool {
+	return info.NChannels == 0 || channelCount(code) == int(info.NChannels)
+}
+
+// codedDepth returns the bit depth of a sample size code, 0 when it defers to
+// STREAMINFO.
+func codedDepth(code byte) uint8 {
+	depths := [...]uint8{0, 8, 12, 0, 16, 20, 24, 32}
+
+	return depths[code]
+}
+
+// depthMatches reports whether a sample size code agrees with STREAMINFO.
+func depthMatches(code byte, info *meta.StreamInfo) bool {
+	return code == 0 || info.BitsPerSample == 0 || codedDepth(code) == info.BitsPerSample
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	goflac "github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+var (
+	errSignature    = errors.New("invalid FLAC signature")
+	errNoStreamInfo = errors.New("first metadata block is not STREAMINFO")
+)
+
+const (
+	// id3HeaderSize is the length of an ID3v2 tag header (and footer, when present).
+	id3HeaderSize = 10
+	// id3FooterFlag marks an ID3v2.4 tag followed by a footer.
+	id3FooterFlag = 0x10
+)
+
+//nolint:gochecknoglobals
+var id3Signature = []byte("ID3")
+
+// streamHeader is the metadata section of a FLAC stream, parsed in-repo so the
+// decoder knows where audio frames start and can restart goflac at any frame.
+type streamHeader struct {
+	info     *meta.StreamInfo
+	metadata *Metadata
+	// Number of bytes before the signature, i.e. the length of a leading ID3v2 tag.
+	prefix int64
+	// Number of bytes from the start of the source (ID3v2 tag included) to the first frame.
+	size int64
+}
+
+// countingReader tracks how many bytes were consumed from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err //nolint:wrapcheck // Transparent pass-through reader.
+}
+
+// readStreamHeader parses the FLAC signature (skipping a leading ID3v2 tag),
+// STREAMINFO and the remaining metadata blocks, leaving r positioned at the
+// first audio frame. Malformed blocks other than STREAMINFO are kept as
+// RawBlock rather than failing the stream.
+func readStreamHeader(r io.Reader) (*streamHeader, error) {
+	cr := &countingReader{r: r}
+
+	var sig [signatureSize]byte
+	if _, err := io.ReadFull(cr, sig[:]); err != nil {
+		return nil, fmt.Errorf("reading signature: %w", err)
+	}
+
+	if bytes.Equal(sig[:len(id3Signature)], id3Signature) {
+		if err := skipID3v2(cr, sig[len(id3Signature):]); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(cr, sig[:]); err != nil {
+			return nil, fmt.Errorf("reading signature: %w", err)
+		}
+	}
+
+	if !bytes.Equal(sig[:], flacSignature) {
+		return nil, fmt.Errorf("%w: %q", errSignature, sig)
+	}
+
+	prefix := cr.n - signatureSize
+
+	block, err := meta.Parse(cr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing STREAMINFO: %w", err)
+	}
+
+	info, ok := block.Body.(*meta.StreamInfo)
+	if !ok {
+		return nil, fmt.Errorf("%w: got %T", errNoStreamInfo, block.Body)
+	}
+
+	if err := block.Skip(); err != nil {
+		return nil, fmt.Errorf("skipping metadata block: %w", err)
+	}
+
+	header := &streamHeader{
+		info:     info,
+		metadata: &Metadata{StreamInfo: streamInfoFromMeta(info)},
+		prefix:   prefix,
+	}
+
+	for last := block.IsLast; !last; {
+		var next Block
+
+		if next, last, err = readBlock(cr); err != nil {
+			return nil, err
+		}
+
+		header.metadata.Blocks = append(header.metadata.Blocks, next)
+	}
+
+	header.size = cr.n
+
+	return header, nil
+}
+
+// readBlock reads the metadata block at the start of r and reports whether it
+// is the last one. PADDING bodies are discarded rather than buffered.
+func readBlock(r io.Reader) (Block, bool, error) {
+	var hdr [blockHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, false, fmt.Errorf("reading metadata block header: %w", err)
+	}
+
+	last := hdr[0]&0x80 != 0
+	typ := BlockType(hdr[0] & 0x7F)
+	length := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+
+	switch typ {
+	case BlockStreamInfo, blockInvalid:
+		return nil, false, fmt.Errorf("%w: %d", ErrInvalidBlock, typ)
+	case BlockPadding:
+		if _, err := io.CopyN(io.Discard, r, length); err != nil {
+			return nil, false, fmt.Errorf("skipping padding: %w", err)
+		}
+
+		return &Padding{Length: int(length)}, last, nil
+	default:
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, false, fmt.Errorf("reading metadata block: %w", err)
+	}
+
+	return parseBlock(typ, body), last, nil
+}
+
+// skipID3v2 discards an ID3v2 tag whose first signatureSize bytes were already
+// read; rest holds the bytes read past the "ID3" marker.
+func skipID3v2(r io.Reader, rest []byte) error {
+	var hdr [id3HeaderSize]byte
+
+	copy(hdr[len(id3Signature):], rest)
+
+	if _, err := io.ReadFull(r, hdr[len(id3Signature)+len(rest):]); err != nil {
+		return fmt.Errorf("reading ID3v2 header: %w", err)
+	}
+
+	// The size is a synchsafe integer: 7 bits per byte.
+	size := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+	if hdr[5]&id3FooterFlag != 0 {
+		size += id3HeaderSize
+	}
+
+	if _, err := io.CopyN(io.Discard, r, size); err != nil {
+		return fmt.Errorf("skipping ID3v2 tag: %w", err)
+	}
+
+	return nil
+}
+
+// framePreamble returns a minimal stream header (signature and STREAMINFO only)
+// that lets goflac decode frames taken from anywhere in a stream.
+func framePreamble(info *meta.StreamInfo) []byte {
+	preamble := append([]byte{}, flacSignature...)
+
+	return appendStreamInfo(preamble, info, true)
+}
+
+// openFrames returns a goflac stream decoding the frames read from r, which
+// must be positioned at a frame header.
+func openFrames(preamble []byte, r io.Reader) (*goflac.Stream, error) {
+	stream, err := goflac.New(io.MultiReader(bytes.NewReader(preamble), r))
+	if err != nil {
+		return nil, fmt.Errorf("opening frames: %w", err)
+	}
+
+	return stream, nil
+}
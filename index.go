@@ -0,0 +1,244 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+var (
+	// ErrInvalidIndex is returned when unmarshaling a malformed FrameIndex.
+	ErrInvalidIndex = errors.New("invalid frame index")
+
+	// ErrIndexMismatch is returned by NewDecoder when a FrameIndex was built
+	// from a different stream than the one being decoded.
+	ErrIndexMismatch = errors.New("frame index does not match stream")
+)
+
+const (
+	// indexVersion is the version byte of the FrameIndex binary encoding.
+	indexVersion = 1
+	// indexEntryMinSize is the smallest encoded entry: two one-byte uvarints.
+	indexEntryMinSize = 2
+	// maxIndexDelta bounds the distance between frames: twice the largest
+	// block of the widest stream stored verbatim.
+	maxIndexDelta = (MaxBlockSize + 1) * 8 * 4 * 2
+)
+
+//nolint:gochecknoglobals
+var indexMagic = []byte("SFIX")
+
+// indexEntry locates one audio frame.
+type indexEntry struct {
+	// Offset of the frame header from the first frame.
+	offset int64
+	// First inter-channel sample of the frame.
+	sample    uint64
+	blockSize uint32
+}
+
+// FrameIndex records the position of every audio frame in a FLAC stream, so a
+// Decoder can seek to any sample without a SEEKTABLE or bisection. Offsets are
+// relative to the first frame, which keeps an index valid when the metadata in
+// front of the audio is rewritten.
+type FrameIndex struct {
+	entries []indexEntry
+	// Total inter-channel samples covered by the frames.
+	samples uint64
+}
+
+// BuildIndex scans the frames of the FLAC stream read from rs once and returns
+// their offsets, first samples and block sizes. Frame headers are found by
+// their sync code and CRC-8; each must start where the previous frame's samples
+// end, which rejects sync codes that occur by chance inside audio data.
+func BuildIndex(rs io.ReadSeeker) (*FrameIndex, error) {
+	_, index, err := buildIndex(rs)
+
+	return index, err
+}
+
+// buildIndex implements BuildIndex, also returning the stream header.
+func buildIndex(r io.Reader) (*streamHeader, *FrameIndex, error) {
+	header, err := readStreamHeader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	index := &FrameIndex{}
+	buf := make([]byte, 0, scanChunkSize+maxFrameHeaderSize)
+	// Offset of buf[0] from the first frame.
+	var base int64
+
+	for eof := false; !eof; {
+		// Keep the unscanned tail, which may hold the start of a header.
+		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			eof = true
+		case err != nil:
+			return nil, nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+
+		scan := len(buf)
+		if !eof {
+			scan -= maxFrameHeaderSize
+		}
+
+		next := index.scan(buf[:scan], buf, base, header.info)
+
+		base += int64(next)
+		buf = buf[:copy(buf, buf[next:])]
+	}
+
+	if total := header.info.NSamples; total != 0 && index.samples != total {
+		return nil, nil, fmt.Errorf("%w: frames cover %d of %d samples", ErrReadFailure, index.samples, total)
+	}
+
+	return header, index, nil
+}
+
+// scan records the frames whose header starts in window, a prefix of buf
+// starting base bytes after the first frame. It returns how far into buf the
+// next scan must resume.
+func (x *FrameIndex) scan(window, buf []byte, base int64, info *meta.StreamInfo) int {
+	pos := 0
+
+	for pos < len(window) {
+		found := bytes.IndexByte(window[pos:], frameSyncByte)
+		if found < 0 {
+			return len(window)
+		}
+
+		pos += found
+
+		hdr, ok := parseFrameHeader(buf[pos:], info)
+		if !ok || hdr.sampleNum != x.samples {
+			pos++
+
+			continue
+		}
+
+		x.entries = append(x.entries, indexEntry{
+			offset:    base + int64(pos),
+			sample:    hdr.sampleNum,
+			blockSize: uint32(hdr.blockSize), //nolint:gosec // Block sizes fit 16 bits.
+		})
+		x.samples += uint64(hdr.blockSize) //nolint:gosec // Block sizes are positive.
+		pos += hdr.size
+	}
+
+	return pos
+}
+
+// Len returns the number of indexed frames.
+func (x *FrameIndex) Len() int { return len(x.entries) }
+
+// TotalSamples returns the number of inter-channel samples the indexed frames hold.
+func (x *FrameIndex) TotalSamples() uint64 { return x.samples }
+
+// lookup returns the frame holding sample target, as an absolute position given
+// the offset of the first frame.
+func (x *FrameIndex) lookup(target uint64, dataStart int64) seekBound {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].sample > target }) - 1
+	if i < 0 {
+		return seekBound{offset: dataStart}
+	}
+
+	return seekBound{offset: dataStart + x.entries[i].offset, sample: x.entries[i].sample}
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding is a magic
+// string and version byte followed by the frame count and, per frame, the
+// byte distance from the previous frame and the block size as uvarints.
+func (x *FrameIndex) MarshalBinary() ([]byte, error) {
+	data := append([]byte{}, indexMagic...)
+	data = append(data, indexVersion)
+	data = binary.AppendUvarint(data, uint64(len(x.entries)))
+
+	var prev int64
+
+	for _, entry := range x.entries {
+		data = binary.AppendUvarint(data, uint64(entry.offset-prev)) //nolint:gosec // Offsets increase.
+		data = binary.AppendUvarint(data, uint64(entry.blockSize))
+		prev = entry.offset
+	}
+
+	return data, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (x *FrameIndex) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, indexMagic) || len(data) <= len(indexMagic) {
+		return fmt.Errorf("%w: bad magic", ErrInvalidIndex)
+	}
+
+	if version := data[len(indexMagic)]; version != indexVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidIndex, version)
+	}
+
+	data = data[len(indexMagic)+1:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)/indexEntryMinSize) {
+		return fmt.Errorf("%w: bad frame count", ErrInvalidIndex)
+	}
+
+	data = data[n:]
+	entries := make([]indexEntry, 0, count)
+
+	var (
+		offset  int64
+		samples uint64
+	)
+
+	for i := range count {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 || delta > uint64(maxIndexDelta) || i > 0 && delta == 0 {
+			return fmt.Errorf("%w: bad offset for frame %d", ErrInvalidIndex, i)
+		}
+
+		data = data[n:]
+
+		blockSize, n := binary.Uvarint(data)
+		if n <= 0 || blockSize == 0 || blockSize > MaxBlockSize+1 {
+			return fmt.Errorf("%w: bad block size for frame %d", ErrInvalidIndex, i)
+		}
+
+		data = data[n:]
+		offset += int64(delta) //nolint:gosec // Bounded by maxIndexDelta.
+		entries = append(entries, indexEntry{offset: offset, sample: samples, blockSize: uint32(blockSize)})
+		samples += blockSize
+	}
+
+	if len(data) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidIndex, len(data))
+	}
+
+	x.entries = entries
+	x.samples = samples
+
+	return nil
+}
@@ -0,0 +1,418 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"math"
+
+	"github.com/mewkiz/flac/frame"
+)
+
+const (
+	// MaxLPCOrderSubset is the highest LPC order allowed in the FLAC streamable subset.
+	MaxLPCOrderSubset = 12
+	// MaxLPCOrder is the highest LPC order the FLAC format can express.
+	MaxLPCOrder = 32
+
+	minQLPPrecision = 5
+	maxQLPPrecision = 15
+	// The coefficient shift is a 5-bit field; decoders reject negative shifts.
+	maxQLPShift = 15
+
+	// 4 bits coefficient precision + 5 bits coefficient shift.
+	lpcHeaderBits = 4 + 5
+
+	defaultTukeyP = 0.5
+)
+
+// lpcAnalysis holds the per-block state of the LPC search: the windowed
+// autocorrelation and the Levinson-Durbin solutions for every order.
+type lpcAnalysis struct {
+	windowed []float64
+	autoc    [MaxLPCOrder + 1]float64
+	// coeffs[order-1] holds the predictor of that order; errs[order-1] its prediction error.
+	coeffs [MaxLPCOrder][MaxLPCOrder]float64
+	errs   [MaxLPCOrder]float64
+	// Highest order Levinson-Durbin produced (lower when the signal is fully predictable).
+	maxOrder int
+	qcoeffs  [MaxLPCOrder]int32
+}
+
+// windowsFor returns the configured apodization windows realized for blocks of
+// size samples, reusing them while the block size does not change.
+func (p *planner) windowsFor(size int) [][]float64 {
+	if p.windowSize == size && p.windowCache != nil {
+		return p.windowCache
+	}
+
+	p.windowCache = p.windowCache[:0]
+	p.windowSize = size
+
+	for _, window := range p.windows {
+		p.windowCache = window.realize(p.windowCache, size)
+	}
+
+	return p.windowCache
+}
+
+// realize appends the window arrays w stands for (several for partial and
+// punchout windows) at the given block size.
+func (w Window) realize(dst [][]float64, size int) [][]float64 {
+	switch w.kind {
+	case windowRectangle:
+		window := make([]float64, size)
+		tukeyWindow(window, 0)
+
+		return append(dst, window)
+	case windowHann:
+		window := make([]float64, size)
+		tukeyWindow(window, 1)
+
+		return append(dst, window)
+	case windowTukey:
+		window := make([]float64, size)
+		tukeyWindow(window, w.ratio)
+
+		return append(dst, window)
+	case windowPartialTukey, windowPunchoutTukey:
+		for part := range w.parts {
+			start, end := part*size/w.parts, (part+1)*size/w.parts
+			window := make([]float64, size)
+
+			if w.kind == windowPartialTukey {
+				// Only this sub-block contributes.
+				tukeyWindow(window[start:end], w.ratio)
+			} else {
+				// Everything but this sub-block contributes.
+				tukeyWindow(window[:start], w.ratio)
+				tukeyWindow(window[end:], w.ratio)
+			}
+
+			dst = append(dst, window)
+		}
+	}
+
+	return dst
+}
+
+// tukeyWindow fills window with a Tukey (tapered cosine) window of ratio p.
+// p=0 is rectangular and p=1 is a Hann window.
+func tukeyWindow(window []float64, p float64) {
+	size := len(window)
+	for i := range window {
+		window[i] = 1
+	}
+
+	taper := int(p/2*float64(size)) - 1
+	if taper <= 0 {
+		return
+	}
+
+	for i := 0; i <= taper; i++ {
+		window[i] = 0.5 - 0.5*math.Cos(math.Pi*float64(i)/float64(taper))
+		window[size-taper-1+i] = 0.5 - 0.5*math.Cos(math.Pi*float64(i+taper)/float64(taper))
+	}
+}
+
+// analyze windows the samples, computes autocorrelation up to maxOrder lags and
+// runs Levinson-Durbin. It reports false when the block carries no signal.
+//
+//nolint:varnamelen // i, j are the lag indices of the Levinson-Durbin recursion.
+func (a *lpcAnalysis) analyze(samples []int32, window []float64, maxOrder int) bool {
+	size := len(samples)
+	if cap(a.windowed) < size {
+		a.windowed = make([]float64, size)
+	}
+
+	data := a.windowed[:size]
+	for i, s := range samples {
+		data[i] = float64(s) * window[i]
+	}
+
+	for lag := 0; lag <= maxOrder; lag++ {
+		var sum float64
+		for i := lag; i < size; i++ {
+			sum += data[i] * data[i-lag]
+		}
+
+		a.autoc[lag] = sum
+	}
+
+	if a.autoc[0] == 0 {
+		return false
+	}
+
+	var lpc [MaxLPCOrder]float64
+
+	errVal := a.autoc[0]
+	a.maxOrder = maxOrder
+
+	for i := range maxOrder {
+		reflection := -a.autoc[i+1]
+		for j := range i {
+			reflection -= lpc[j] * a.autoc[i-j]
+		}
+
+		reflection /= errVal
+		lpc[i] = reflection
+
+		var j int
+		for j = 0; j < i>>1; j++ {
+			tmp := lpc[j]
+			lpc[j] += reflection * lpc[i-1-j]
+			lpc[i-1-j] += reflection * tmp
+		}
+
+		if i&1 != 0 {
+			lpc[j] += lpc[j] * reflection
+		}
+
+		errVal *= 1 - reflection*reflection
+
+		// Negate the FIR filter to get predictor coefficients.
+		for j := 0; j <= i; j++ {
+			a.coeffs[i][j] = -lpc[j]
+		}
+
+		a.errs[i] = errVal
+
+		if errVal <= 0 {
+			a.maxOrder = i + 1
+
+			break
+		}
+	}
+
+	return true
+}
+
+// estimateOrder returns the order whose expected residual size plus coefficient
+// overhead is smallest, judged from the Levinson-Durbin prediction errors.
+func (a *lpcAnalysis) estimateOrder(size int, bps uint, precision int) int {
+	bestOrder := 1
+	bestBits := math.Inf(1)
+	errScale := 0.5 / float64(size)
+
+	for order := 1; order <= a.maxOrder; order++ {
+		perSample := 0.0
+		if e := a.errs[order-1] * errScale; e > 0 {
+			perSample = max(0, 0.5*math.Log2(e))
+		}
+
+		bits := perSample*float64(size-order) + float64(order)*float64(int(bps)+precision)
+		if bits < bestBits {
+			bestBits = bits
+			bestOrder = order
+		}
+	}
+
+	return bestOrder
+}
+
+// quantize converts the predictor of the given order to integer coefficients of
+// the given precision, returning the shift to apply to the prediction. It
+// reports false when the coefficients cannot be represented with a
+// non-negative shift.
+func (a *lpcAnalysis) quantize(order, precision int) ([]int32, int, bool) {
+	lpc := a.coeffs[order-1][:order]
+
+	cmax := 0.0
+	for _, c := range lpc {
+		cmax = max(cmax, math.Abs(c))
+	}
+
+	if cmax <= 0 || math.IsInf(cmax, 0) || math.IsNaN(cmax) {
+		return nil, 0, false
+	}
+
+	// One bit of the precision holds the sign.
+	bits := precision - 1
+	qmax := int64(1)<<bits - 1
+	qmin := -(int64(1) << bits)
+
+	_, log2cmax := math.Frexp(cmax)
+	log2cmax--
+
+	shift := min(bits-log2cmax-1, maxQLPShift)
+	if shift < 0 {
+		return nil, 0, false
+	}
+
+	// Quantize with error feedback so rounding errors do not accumulate.
+	qcoeffs := a.qcoeffs[:order]
+	carry := 0.0
+
+	for i, c := range lpc {
+		carry += c * float64(int64(1)<<shift)
+		q := min(max(int64(math.Round(carry)), qmin), qmax)
+		carry -= float64(q)
+		qcoeffs[i] = int32(q) //nolint:gosec // Clamped to precision bits (<= 15).
+	}
+
+	return qcoeffs, shift, true
+}
+
+// defaultQLPPrecision mirrors libFLAC's automatic coefficient precision, which
+// grows with bit depth and block size.
+func defaultQLPPrecision(bps uint, blockSize int) int {
+	switch {
+	case bps < 16:
+		return max(minQLPPrecision, 2+int(bps)/2) //nolint:gosec // bps is at most 33.
+	case bps == 16:
+		switch {
+		case blockSize <= 192:
+			return 7
+		case blockSize <= 384:
+			return 8
+		case blockSize <= 576:
+			return 9
+		case blockSize <= 1152:
+			return 10
+		case blockSize <= 2304:
+			return 11
+		case blockSize <= 4608:
+			return 12
+		default:
+			return 13
+		}
+	default:
+		switch {
+		case blockSize <= 384:
+			return maxQLPPrecision - 2
+		case blockSize <= 1152:
+			return maxQLPPrecision - 1
+		default:
+			return maxQLPPrecision
+		}
+	}
+}
+
+// lpcResiduals appends the residuals of the quantized predictor to dst,
+// reporting false if any residual overflows 32 bits.
+//
+//nolint:varnamelen // i, j follow the FLAC specification's predictor notation.
+func lpcResiduals(dst, samples, qcoeffs []int32, shift int) ([]int32, bool) {
+	order := len(qcoeffs)
+	for i := order; i < len(samples); i++ {
+		var pred int64
+		for j, c := range qcoeffs {
+			pred += int64(c) * int64(samples[i-j-1])
+		}
+
+		residual := int64(samples[i]) - pred>>shift
+		if residual < math.MinInt32 || residual > math.MaxInt32 {
+			return nil, false
+		}
+
+		dst = append(dst, int32(residual))
+	}
+
+	return dst, true
+}
+
+// planLPC evaluates LPC candidates for samples and returns the cheapest, or
+// false when LPC is not applicable to this block.
+func (p *planner) planLPC(samples []int32, bps uint) (subframePlan, bool) {
+	size := len(samples)
+
+	maxOrder := min(p.maxLPCOrder, size-1)
+	if maxOrder < 1 {
+		return subframePlan{}, false
+	}
+
+	precision := p.qlpPrecision
+	if precision == 0 {
+		precision = defaultQLPPrecision(bps, size)
+	}
+
+	var (
+		best  subframePlan
+		found bool
+	)
+
+	for _, window := range p.windowsFor(size) {
+		if !p.lpc.analyze(samples, window, maxOrder) {
+			continue
+		}
+
+		if candidate, ok := p.searchLPC(samples, bps, precision); ok && (!found || candidate.bits < best.bits) {
+			best, found = candidate, true
+		}
+	}
+
+	return best, found
+}
+
+// searchLPC quantizes the predictors of the current analysis over the
+// configured order and precision ranges and returns the cheapest.
+func (p *planner) searchLPC(samples []int32, bps uint, precision int) (subframePlan, bool) {
+	size := len(samples)
+
+	minOrder, topOrder := 1, p.lpc.maxOrder
+	if !p.exhaustive {
+		minOrder = p.lpc.estimateOrder(size, bps, precision)
+		topOrder = minOrder
+	}
+
+	minPrecision, maxPrecision := precision, precision
+	if p.precisionSearch {
+		minPrecision, maxPrecision = minQLPPrecision, maxQLPPrecision
+	}
+
+	var (
+		best  subframePlan
+		found bool
+	)
+
+	for order := minOrder; order <= topOrder; order++ {
+		for prec := minPrecision; prec <= maxPrecision; prec++ {
+			qcoeffs, shift, ok := p.lpc.quantize(order, prec)
+			if !ok {
+				continue
+			}
+
+			residuals, ok := lpcResiduals(p.residualBuffer(size), samples, qcoeffs, shift)
+			if !ok {
+				continue
+			}
+
+			method, rice, residualBits := p.planResidual(residuals, size, order)
+
+			//nolint:gosec // order and prec are small positive values.
+			bits := uint64(order)*uint64(bps) + lpcHeaderBits + uint64(order*prec) + residualBits
+			if found && bits >= best.bits {
+				continue
+			}
+
+			best = subframePlan{
+				header: frame.SubHeader{
+					Pred:                 frame.PredFIR,
+					Order:                order,
+					CoeffPrec:            uint(prec),   //nolint:gosec // prec is 5-15.
+					CoeffShift:           int32(shift), //nolint:gosec // shift is 0-15.
+					Coeffs:               append([]int32(nil), qcoeffs...),
+					ResidualCodingMethod: method,
+					RiceSubframe:         rice,
+				},
+				bits: bits,
+			}
+			found = true
+		}
+	}
+
+	return best, found
+}
@@ -0,0 +1,314 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+// BlockType identifies a metadata block.
+type BlockType uint8
+
+// Metadata block types defined by RFC 9639. Types 7-126 are reserved and
+// surface as RawBlock.
+const (
+	BlockStreamInfo BlockType = iota
+	BlockPadding
+	BlockApplication
+	BlockSeekTable
+	BlockVorbisComment
+	BlockCueSheet
+	BlockPicture
+
+	// blockInvalid is forbidden, to avoid confusion with a frame sync code.
+	blockInvalid BlockType = 127
+)
+
+// PlaceholderSample is the sample number of a placeholder seek point, which
+// reserves room in a SEEKTABLE without pointing anywhere.
+const PlaceholderSample = meta.PlaceholderPoint
+
+// Block is a metadata block following STREAMINFO: one of *Padding,
+// *Application, *SeekTable, *VorbisComment, *CueSheet, *Picture or *RawBlock.
+// Other types of block can be carried as a RawBlock.
+type Block interface {
+	Type() BlockType
+	appendBody(dst []byte) []byte
+}
+
+// Metadata is the metadata section of a FLAC stream.
+type Metadata struct {
+	StreamInfo StreamInfo
+	// Blocks holds the blocks after STREAMINFO, in stream order.
+	Blocks []Block
+}
+
+// StreamInfo holds the STREAMINFO block.
+type StreamInfo struct {
+	// Smallest and largest block size in samples, the last frame excepted.
+	BlockSizeMin, BlockSizeMax uint16
+	// Smallest and largest frame size in bytes; 0 when unknown.
+	FrameSizeMin, FrameSizeMax uint32
+	SampleRate                 uint32
+	Channels                   uint8
+	BitsPerSample              uint8
+	// Inter-channel samples in the stream; 0 when unknown.
+	TotalSamples uint64
+	// MD5 of the decoded audio; all zeros when unknown.
+	MD5 [md5.Size]byte
+}
+
+// Padding is a PADDING block, reserving room for metadata edits.
+type Padding struct {
+	Length int
+}
+
+// Application is an APPLICATION block holding data for a registered application.
+type Application struct {
+	ID   [4]byte
+	Data []byte
+}
+
+// SeekTable is a SEEKTABLE block.
+type SeekTable struct {
+	Points []SeekPoint
+}
+
+// SeekPoint points at the frame holding a sample. Placeholder points have
+// Sample set to PlaceholderSample.
+type SeekPoint struct {
+	// First inter-channel sample of the target frame.
+	Sample uint64
+	// Byte offset of the target frame from the first frame.
+	Offset uint64
+	// Samples in the target frame.
+	Samples uint16
+}
+
+// VorbisComment is a VORBIS_COMMENT block: an encoder vendor string and
+// ordered NAME=value tags. Names are case-insensitive and may repeat.
+type VorbisComment struct {
+	Vendor string
+	Tags   []Tag
+}
+
+// Tag is one Vorbis comment field.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// PictureType is the ID3v2 APIC picture type of a Picture.
+type PictureType uint32
+
+// Picture types.
+const (
+	PictureOther PictureType = iota
+	PictureFileIcon
+	PictureOtherFileIcon
+	PictureFrontCover
+	PictureBackCover
+	PictureLeaflet
+	PictureMedia
+	PictureLeadArtist
+	PictureArtist
+	PictureConductor
+	PictureBand
+	PictureComposer
+	PictureLyricist
+	PictureRecordingLocation
+	PictureDuringRecording
+	PictureDuringPerformance
+	PictureScreenCapture
+	PictureBrightFish
+	PictureIllustration
+	PictureBandLogo
+	PicturePublisherLogo
+)
+
+// Picture is a PICTURE block. A MIME type of "-->" marks Data as a URL.
+type Picture struct {
+	PictureType PictureType
+	MIME        string
+	Description string
+	// Dimensions in pixels, color depth in bits per pixel and palette size
+	// (0 for non-indexed images).
+	Width, Height, Depth, Colors uint32
+	Data                         []byte
+}
+
+// RawBlock holds a block of a reserved type, or one whose body is malformed,
+// as it appears in the stream.
+type RawBlock struct {
+	BlockType BlockType
+	Data      []byte
+}
+
+// Type implements Block.
+func (*Padding) Type() BlockType { return BlockPadding }
+
+// Type implements Block.
+func (*Application) Type() BlockType { return BlockApplication }
+
+// Type implements Block.
+func (*SeekTable) Type() BlockType { return BlockSeekTable }
+
+// Type implements Block.
+func (*VorbisComment) Type() BlockType { return BlockVorbisComment }
+
+// Type implements Block.
+func (*Picture) Type() BlockType { return BlockPicture }
+
+// Type implements Block.
+func (b *RawBlock) Type() BlockType { return b.BlockType }
+
+// VorbisComment returns the first VORBIS_COMMENT block, or nil.
+func (m *Metadata) VorbisComment() *VorbisComment {
+	return firstBlock[*VorbisComment](m.Blocks)
+}
+
+// SeekTable returns the first SEEKTABLE block, or nil.
+func (m *Metadata) SeekTable() *SeekTable {
+	return firstBlock[*SeekTable](m.Blocks)
+}
+
+// CueSheet returns the first CUESHEET block, or nil.
+func (m *Metadata) CueSheet() *CueSheet {
+	return firstBlock[*CueSheet](m.Blocks)
+}
+
+// Pictures returns the PICTURE blocks in stream order.
+func (m *Metadata) Pictures() []*Picture {
+	var pictures []*Picture
+
+	for _, block := range m.Blocks {
+		if picture, ok := block.(*Picture); ok {
+			pictures = append(pictures, picture)
+		}
+	}
+
+	return pictures
+}
+
+func firstBlock[T Block](blocks []Block) T {
+	for _, block := range blocks {
+		if typed, ok := block.(T); ok {
+			return typed
+		}
+	}
+
+	var zero T
+
+	return zero
+}
+
+// Get returns the values of every tag named name, compared case-insensitively.
+func (c *VorbisComment) Get(name string) []string {
+	var values []string
+
+	for _, tag := range c.Tags {
+		if strings.EqualFold(tag.Name, name) {
+			values = append(values, tag.Value)
+		}
+	}
+
+	return values
+}
+
+// validTagName reports whether name is a legal Vorbis comment field name:
+// printable ASCII other than '='.
+func validTagName(name string) bool {
+	for i := range len(name) {
+		if c := name[i]; c < 0x20 || c > 0x7D || c == '=' {
+			return false
+		}
+	}
+
+	return name != ""
+}
+
+// parseBlock converts a block body read from the stream. Bodies goflac rejects
+// are kept as a RawBlock rather than failing the stream.
+func parseBlock(typ BlockType, body []byte) Block {
+	if typ > BlockPicture {
+		return &RawBlock{BlockType: typ, Data: body}
+	}
+
+	raw := appendBlockHeader(make([]byte, 0, blockHeaderSize+len(body)), meta.Type(typ), len(body), true)
+
+	block, err := meta.Parse(bytes.NewReader(append(raw, body...)))
+	if err != nil {
+		return &RawBlock{BlockType: typ, Data: body}
+	}
+
+	switch parsed := block.Body.(type) {
+	case *meta.Application:
+		app := &Application{Data: parsed.Data}
+		binary.BigEndian.PutUint32(app.ID[:], parsed.ID)
+
+		return app
+	case *meta.SeekTable:
+		table := &SeekTable{Points: make([]SeekPoint, len(parsed.Points))}
+		for i, point := range parsed.Points {
+			table.Points[i] = SeekPoint{Sample: point.SampleNum, Offset: point.Offset, Samples: point.NSamples}
+		}
+
+		return table
+	case *meta.VorbisComment:
+		comment := &VorbisComment{Vendor: parsed.Vendor, Tags: make([]Tag, len(parsed.Tags))}
+		for i, tag := range parsed.Tags {
+			comment.Tags[i] = Tag{Name: tag[0], Value: tag[1]}
+		}
+
+		return comment
+	case *meta.CueSheet:
+		return cueSheetFromMeta(parsed)
+	case *meta.Picture:
+		return &Picture{
+			PictureType: PictureType(parsed.Type),
+			MIME:        parsed.MIME,
+			Description: parsed.Desc,
+			Width:       parsed.Width,
+			Height:      parsed.Height,
+			Depth:       parsed.Depth,
+			Colors:      parsed.NPalColors,
+			Data:        parsed.Data,
+		}
+	default:
+		return &RawBlock{BlockType: typ, Data: body}
+	}
+}
+
+// streamInfoFromMeta converts goflac's STREAMINFO.
+func streamInfoFromMeta(info *meta.StreamInfo) StreamInfo {
+	return StreamInfo{
+		BlockSizeMin:  info.BlockSizeMin,
+		BlockSizeMax:  info.BlockSizeMax,
+		FrameSizeMin:  info.FrameSizeMin,
+		FrameSizeMax:  info.FrameSizeMax,
+		SampleRate:    info.SampleRate,
+		Channels:      info.NChannels,
+		BitsPerSample: info.BitsPerSample,
+		TotalSamples:  info.NSamples,
+		MD5:           info.MD5sum,
+	}
+}
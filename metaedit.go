@@ -0,0 +1,262 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultPadding is the PADDING left after the metadata when a file has to be
+// rewritten, so later edits of similar size happen in place (as flac's default).
+const defaultPadding = 8192
+
+// ReadMetadata reads the metadata blocks of the FLAC stream from r, stopping at
+// the first audio frame.
+func ReadMetadata(r io.Reader) (*Metadata, error) {
+	header, err := readStreamHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	return header.metadata, nil
+}
+
+// UpdateMetadata replaces the metadata of the FLAC file at path with md,
+// copying the audio frames byte for byte. The file keeps its STREAMINFO, which
+// md must match or leave zero. PADDING blocks in md are ignored: when the new
+// blocks fit in the space of the old ones, the file is overwritten in place
+// and the remainder becomes a single PADDING block. Otherwise the file is
+// rewritten, with defaultPadding bytes of padding, to a temporary file that
+// atomically replaces the original. A leading ID3v2 tag is preserved.
+func UpdateMetadata(path string, md *Metadata) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	header, err := readStreamHeader(bufio.NewReader(file))
+	if err != nil {
+		_ = file.Close()
+
+		return fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	// The audio is copied as is, so it keeps the STREAMINFO describing it.
+	md, err = editedMetadata(md, header.metadata.StreamInfo)
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	encoded, err := appendMetadata(nil, md, -1)
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	// The space between the signature and the first frame.
+	available := header.size - header.prefix
+	free := available - int64(len(encoded))
+
+	if free == 0 || free >= blockHeaderSize && free-blockHeaderSize <= maxBlockLength {
+		if free > 0 {
+			if encoded, err = appendMetadata(encoded[:0], md, int(free-blockHeaderSize)); err != nil {
+				_ = file.Close()
+
+				return err
+			}
+		}
+
+		_, err = file.WriteAt(encoded, header.prefix)
+		if err == nil {
+			err = file.Sync()
+		}
+
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return fmt.Errorf("writing metadata: %w", err)
+		}
+
+		return nil
+	}
+
+	tmpPath, err := rewriteFile(file, path, header, md)
+	_ = file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// editedMetadata returns md with the STREAMINFO info of the file being edited.
+// It rejects a STREAMINFO other than info, unless left zero as in hand-built
+// metadata, and tag names other readers reject.
+func editedMetadata(md *Metadata, info StreamInfo) (*Metadata, error) {
+	if md.StreamInfo != (StreamInfo{}) && md.StreamInfo != info {
+		return nil, fmt.Errorf("%w: STREAMINFO differs from the file's", ErrInvalidBlock)
+	}
+
+	for _, block := range md.Blocks {
+		comment, ok := block.(*VorbisComment)
+		if !ok {
+			continue
+		}
+
+		for _, tag := range comment.Tags {
+			if !validTagName(tag.Name) {
+				return nil, fmt.Errorf("%w: tag name %q", ErrInvalidBlock, tag.Name)
+			}
+		}
+	}
+
+	edited := *md
+	edited.StreamInfo = info
+
+	return &edited, nil
+}
+
+// rewriteFile writes src with md in place of its metadata to a temporary file
+// next to path, and returns the temporary file's name.
+func rewriteFile(src *os.File, path string, header *streamHeader, md *Metadata) (string, error) {
+	encoded, err := appendMetadata(nil, md, defaultPadding)
+	if err != nil {
+		return "", err
+	}
+
+	stat, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("stat %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	err = copySection(tmp, src, 0, header.prefix)
+	if err == nil {
+		_, err = tmp.Write(encoded)
+	}
+
+	if err == nil {
+		err = copySection(tmp, src, header.size, stat.Size()-header.size)
+	}
+
+	if err == nil {
+		err = tmp.Chmod(stat.Mode().Perm())
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+
+		return "", fmt.Errorf("rewriting %s: %w", path, err)
+	}
+
+	return tmp.Name(), nil
+}
+
+// copySection copies n bytes of src starting at offset to dst.
+func copySection(dst io.Writer, src io.ReaderAt, offset, n int64) error {
+	_, err := io.Copy(dst, io.NewSectionReader(src, offset, n))
+
+	return err //nolint:wrapcheck // Wrapped by rewriteFile.
+}
+
+// SetVorbisComment replaces the VORBIS_COMMENT block with comment, or appends
+// one when there is none. A nil comment removes the block.
+func (m *Metadata) SetVorbisComment(comment *VorbisComment) {
+	i := slices.IndexFunc(m.Blocks, func(block Block) bool { return block.Type() == BlockVorbisComment })
+
+	switch {
+	case comment == nil:
+		m.RemoveBlocks(BlockVorbisComment)
+	case i < 0:
+		m.Blocks = append(m.Blocks, comment)
+	default:
+		m.Blocks[i] = comment
+		// FLAC allows a single VORBIS_COMMENT block.
+		m.Blocks = slices.DeleteFunc(m.Blocks, func(block Block) bool {
+			return block.Type() == BlockVorbisComment && block != Block(comment)
+		})
+	}
+}
+
+// AddPicture appends a PICTURE block.
+func (m *Metadata) AddPicture(picture *Picture) {
+	m.Blocks = append(m.Blocks, picture)
+}
+
+// RemoveBlocks removes every block of type typ.
+func (m *Metadata) RemoveBlocks(typ BlockType) {
+	m.Blocks = slices.DeleteFunc(m.Blocks, func(block Block) bool { return block.Type() == typ })
+}
+
+// Add appends a tag.
+func (c *VorbisComment) Add(name, value string) {
+	c.Tags = append(c.Tags, Tag{Name: name, Value: value})
+}
+
+// Set replaces the tags named name, compared case-insensitively, with one tag
+// per value, at the position of the first one replaced. Without values, it
+// removes the tags.
+func (c *VorbisComment) Set(name string, values ...string) {
+	i := slices.IndexFunc(c.Tags, func(tag Tag) bool { return strings.EqualFold(tag.Name, name) })
+	if i < 0 {
+		i = len(c.Tags)
+	}
+
+	c.Delete(name)
+
+	tags := make([]Tag, len(values))
+	for j, value := range values {
+		tags[j] = Tag{Name: name, Value: value}
+	}
+
+	c.Tags = slices.Insert(c.Tags, i, tags...)
+}
+
+// Delete removes the tags named name, compared case-insensitively.
+func (c *VorbisComment) Delete(name string) {
+	c.Tags = slices.DeleteFunc(c.Tags, func(tag Tag) bool { return strings.EqualFold(tag.Name, name) })
+}
@@ -0,0 +1,216 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mewkiz/flac/meta"
+)
+
+const (
+	// signatureSize is the length of the "fLaC" stream marker.
+	signatureSize = 4
+	// blockHeaderSize is the length of a metadata block header (last flag, type, 24-bit length).
+	blockHeaderSize = 4
+	// streamInfoSize is the fixed length of a STREAMINFO block body.
+	streamInfoSize = 34
+	// maxBlockLength is the largest body a 24-bit block length can describe.
+	maxBlockLength = 1<<24 - 1
+)
+
+var (
+	// ErrInvalidBlock is returned for a metadata block whose type cannot follow
+	// STREAMINFO, when reading or writing, and for metadata UpdateMetadata
+	// cannot write to a file.
+	ErrInvalidBlock = errors.New("invalid metadata block")
+
+	// ErrBlockTooLarge is returned when a metadata block body exceeds the
+	// 16 MiB a block header can describe.
+	ErrBlockTooLarge = errors.New("metadata block too large")
+)
+
+//nolint:gochecknoglobals
+var flacSignature = []byte("fLaC")
+
+// appendBlockHeader appends a metadata block header to dst.
+func appendBlockHeader(dst []byte, typ meta.Type, length int, last bool) []byte {
+	first := byte(typ) & 0x7F
+	if last {
+		first |= 0x80
+	}
+
+	//nolint:gosec // Block lengths are bounded to 24 bits by callers.
+	return append(dst, first, byte(length>>16), byte(length>>8), byte(length))
+}
+
+// appendStreamInfo appends a complete STREAMINFO block (header and body) to dst.
+func appendStreamInfo(dst []byte, info *meta.StreamInfo, last bool) []byte {
+	dst = appendBlockHeader(dst, meta.TypeStreamInfo, streamInfoSize, last)
+
+	return appendStreamInfoBody(dst, info)
+}
+
+// appendStreamInfoBody appends the 34-byte STREAMINFO body to dst.
+func appendStreamInfoBody(dst []byte, info *meta.StreamInfo) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, info.BlockSizeMin)
+	dst = binary.BigEndian.AppendUint16(dst, info.BlockSizeMax)
+	dst = append(dst,
+		byte(info.FrameSizeMin>>16), byte(info.FrameSizeMin>>8), byte(info.FrameSizeMin),
+		byte(info.FrameSizeMax>>16), byte(info.FrameSizeMax>>8), byte(info.FrameSizeMax),
+	)
+
+	// 20 bits sample rate, 3 bits (channels-1), 5 bits (bps-1), 36 bits total samples.
+	packed := uint64(info.SampleRate&0xFFFFF)<<44 |
+		uint64((info.NChannels-1)&0x7)<<41 |
+		uint64((info.BitsPerSample-1)&0x1F)<<36 |
+		info.NSamples&0xFFFFFFFFF
+	dst = binary.BigEndian.AppendUint64(dst, packed)
+
+	return append(dst, info.MD5sum[:]...)
+}
+
+// appendBlock appends a complete metadata block (header and body) to dst.
+func appendBlock(dst []byte, block Block, last bool) ([]byte, error) {
+	typ := block.Type()
+	if typ == BlockStreamInfo || typ >= blockInvalid {
+		return dst, fmt.Errorf("%w: type %d", ErrInvalidBlock, typ)
+	}
+
+	start := len(dst)
+	dst = appendBlockHeader(dst, meta.Type(typ), 0, last)
+	dst = block.appendBody(dst)
+
+	length := len(dst) - start - blockHeaderSize
+	if length > maxBlockLength {
+		return dst[:start], fmt.Errorf("%w: %d bytes of type %d", ErrBlockTooLarge, length, typ)
+	}
+
+	appendBlockHeader(dst[:start], meta.Type(typ), length, last)
+
+	return dst, nil
+}
+
+// appendMetadata appends the signature, STREAMINFO and blocks of md to dst.
+// Padding blocks in md are dropped; when padding is not negative, a single
+// PADDING block of that length ends the chain instead.
+func appendMetadata(dst []byte, md *Metadata, padding int) ([]byte, error) {
+	blocks := make([]Block, 0, len(md.Blocks)+1)
+	for _, block := range md.Blocks {
+		if block.Type() != BlockPadding {
+			blocks = append(blocks, block)
+		}
+	}
+
+	if padding >= 0 {
+		blocks = append(blocks, &Padding{Length: padding})
+	}
+
+	info := streamInfoToMeta(&md.StreamInfo)
+
+	dst = append(dst, flacSignature...)
+	dst = appendStreamInfo(dst, info, len(blocks) == 0)
+
+	for i, block := range blocks {
+		var err error
+		if dst, err = appendBlock(dst, block, i == len(blocks)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	return dst, nil
+}
+
+func (p *Padding) appendBody(dst []byte) []byte {
+	return append(dst, make([]byte, p.Length)...)
+}
+
+func (a *Application) appendBody(dst []byte) []byte {
+	return append(append(dst, a.ID[:]...), a.Data...)
+}
+
+func (s *SeekTable) appendBody(dst []byte) []byte {
+	for _, point := range s.Points {
+		dst = binary.BigEndian.AppendUint64(dst, point.Sample)
+		dst = binary.BigEndian.AppendUint64(dst, point.Offset)
+		dst = binary.BigEndian.AppendUint16(dst, point.Samples)
+	}
+
+	return dst
+}
+
+// appendBody writes the Vorbis comment packet without framing bit, as FLAC
+// stores it: little-endian lengths, unlike every other block.
+//
+//nolint:gosec // Lengths are bounded by maxBlockLength in appendBlock.
+func (c *VorbisComment) appendBody(dst []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(c.Vendor)))
+	dst = append(dst, c.Vendor...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(c.Tags)))
+
+	for _, tag := range c.Tags {
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(tag.Name)+1+len(tag.Value)))
+		dst = append(append(append(dst, tag.Name...), '='), tag.Value...)
+	}
+
+	return dst
+}
+
+//nolint:gosec // Lengths are bounded by maxBlockLength in appendBlock.
+func (p *Picture) appendBody(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(p.PictureType))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(p.MIME)))
+	dst = append(dst, p.MIME...)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(p.Description)))
+	dst = append(dst, p.Description...)
+	dst = binary.BigEndian.AppendUint32(dst, p.Width)
+	dst = binary.BigEndian.AppendUint32(dst, p.Height)
+	dst = binary.BigEndian.AppendUint32(dst, p.Depth)
+	dst = binary.BigEndian.AppendUint32(dst, p.Colors)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(p.Data)))
+
+	return append(dst, p.Data...)
+}
+
+func (b *RawBlock) appendBody(dst []byte) []byte {
+	return append(dst, b.Data...)
+}
+
+// appendPadded appends s truncated or NUL-padded to size bytes.
+func appendPadded(dst []byte, s string, size int) []byte {
+	field := make([]byte, size)
+	copy(field, s)
+
+	return append(dst, field...)
+}
+
+// streamInfoToMeta converts STREAMINFO to goflac's representation.
+func streamInfoToMeta(info *StreamInfo) *meta.StreamInfo {
+	return &meta.StreamInfo{
+		BlockSizeMin:  info.BlockSizeMin,
+		BlockSizeMax:  info.BlockSizeMax,
+		FrameSizeMin:  info.FrameSizeMin,
+		FrameSizeMax:  info.FrameSizeMax,
+		SampleRate:    info.SampleRate,
+		NChannels:     info.Channels,
+		BitsPerSample: info.BitsPerSample,
+		NSamples:      info.TotalSamples,
+		MD5sum:        info.MD5,
+	}
+}
@@ -0,0 +1,535 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+)
+
+// ErrInvalidMP4 is returned when an MP4 file is malformed, fragmented, or
+// holds no FLAC track.
+var ErrInvalidMP4 = errors.New("invalid MP4 file")
+
+const (
+	// mp4BoxHeaderSize is the size and type opening every box; a 64-bit size
+	// may follow.
+	mp4BoxHeaderSize = 8
+	// mp4FullBoxSize is the version and flags opening full boxes.
+	mp4FullBoxSize = 4
+	// mp4AudioEntrySize is the AudioSampleEntry fields before its child boxes.
+	mp4AudioEntrySize = 28
+	// mp4MaxMoovSize bounds the movie box, which holds the sample tables and is
+	// read into memory.
+	mp4MaxMoovSize = 64 << 20
+	// mp4MaxSamples bounds the sample count, hence the tables built from it.
+	mp4MaxSamples = 1 << 24
+)
+
+// mp4Track locates the frames of a FLAC track: each MP4 sample holds one
+// frame, at offsets[i] in the file and sizes[i] bytes long, starting at PCM
+// sample starts[i].
+type mp4Track struct {
+	offsets []int64
+	sizes   []uint32
+	// One entry longer than offsets: the last one is the total sample count.
+	starts []uint64
+}
+
+// frameAt returns the index of the frame holding PCM sample target.
+func (t *mp4Track) frameAt(target uint64) int {
+	return sort.Search(len(t.offsets), func(i int) bool { return t.starts[i+1] > target })
+}
+
+// mp4Box is a box held in memory.
+type mp4Box struct {
+	typ  string
+	body []byte
+}
+
+// readMP4 reads the movie box of the MP4 file at the start of rs and returns
+// the header of its first FLAC track, rebuilt from the dfLa box, along with
+// its sample tables.
+func readMP4(rs io.ReadSeeker) (*streamHeader, *mp4Track, error) {
+	moov, err := readMoov(rs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	boxes, err := mp4Boxes(moov)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, box := range boxes {
+		switch box.typ {
+		case "mvex":
+			return nil, nil, fmt.Errorf("%w: fragmented files are not supported", ErrInvalidMP4)
+		case "trak":
+			header, track, err := readMP4Track(box.body)
+			if err != nil || header != nil {
+				return header, track, err
+			}
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: no FLAC track", ErrInvalidMP4)
+}
+
+// readMoov returns the body of the top-level movie box, skipping the boxes
+// before it, media data included.
+func readMoov(rs io.ReadSeeker) ([]byte, error) {
+	var hdr [mp4BoxHeaderSize + 8]byte
+
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(rs, hdr[:mp4BoxHeaderSize]); err != nil {
+			if errors.Is(err, io.EOF) && !first {
+				return nil, fmt.Errorf("%w: no moov box", ErrInvalidMP4)
+			}
+
+			return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+
+		typ := string(hdr[4:mp4BoxHeaderSize])
+		if first && typ != "ftyp" {
+			return nil, fmt.Errorf("%w: file starts with %q, not ftyp", ErrInvalidMP4, typ)
+		}
+
+		size, headerSize := uint64(binary.BigEndian.Uint32(hdr[:])), uint64(mp4BoxHeaderSize)
+		if size == 1 {
+			if _, err := io.ReadFull(rs, hdr[mp4BoxHeaderSize:]); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrReadFailure, unexpectedEOF(err))
+			}
+
+			size, headerSize = binary.BigEndian.Uint64(hdr[mp4BoxHeaderSize:]), uint64(len(hdr))
+		}
+
+		switch {
+		case size == 0 && typ == "moov":
+			// The box runs to the end of the file.
+			body, err := io.ReadAll(io.LimitReader(rs, mp4MaxMoovSize+1))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+			}
+
+			if len(body) > mp4MaxMoovSize {
+				return nil, fmt.Errorf("%w: moov box over %d bytes", ErrInvalidMP4, mp4MaxMoovSize)
+			}
+
+			return body, nil
+		case size == 0:
+			return nil, fmt.Errorf("%w: no moov box", ErrInvalidMP4)
+		case size < headerSize:
+			return nil, fmt.Errorf("%w: %q box of %d bytes", ErrInvalidMP4, typ, size)
+		case typ == "moov" && size-headerSize > mp4MaxMoovSize:
+			return nil, fmt.Errorf("%w: moov box over %d bytes", ErrInvalidMP4, mp4MaxMoovSize)
+		case typ == "moov":
+			body := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(rs, body); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrReadFailure, unexpectedEOF(err))
+			}
+
+			return body, nil
+		}
+
+		//nolint:gosec // Seeking past the end fails on the next read.
+		if _, err := rs.Seek(int64(size-headerSize), io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+	}
+}
+
+// readMP4Track returns the header and sample tables of trak when it is a
+// FLAC audio track, and a nil header otherwise.
+func readMP4Track(trak []byte) (*streamHeader, *mp4Track, error) {
+	hdlr, err := mp4Child(trak, "mdia", "hdlr")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(hdlr) < mp4FullBoxSize+8 || string(hdlr[mp4FullBoxSize+4:mp4FullBoxSize+8]) != "soun" {
+		return nil, nil, nil
+	}
+
+	stbl, err := mp4Child(trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dfLa, err := mp4FLACConfig(stbl)
+	if err != nil || dfLa == nil {
+		return nil, nil, err
+	}
+
+	header, err := readStreamHeader(bytes.NewReader(append([]byte("fLaC"), dfLa...)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: dfLa box: %w", ErrInvalidMP4, err)
+	}
+
+	timescale, err := mp4Timescale(trak)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	track, err := readMP4Tables(stbl, timescale, header.info.SampleRate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// dfLa may leave the length unknown, which the sample tables tell.
+	if header.info.NSamples == 0 {
+		header.info.NSamples = track.starts[len(track.offsets)]
+		header.metadata.StreamInfo.TotalSamples = header.info.NSamples
+	}
+
+	return header, track, nil
+}
+
+// mp4FLACConfig returns the metadata blocks carried by the dfLa box of the
+// fLaC sample entry in stbl, or nil when the track holds another codec.
+func mp4FLACConfig(stbl []byte) ([]byte, error) {
+	stsd, err := mp4Child(stbl, "stsd")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stsd) < mp4FullBoxSize+4 {
+		return nil, fmt.Errorf("%w: stsd box truncated", ErrInvalidMP4)
+	}
+
+	entries, err := mp4Boxes(stsd[mp4FullBoxSize+4:])
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(entries, func(box mp4Box) bool { return box.typ == "fLaC" })
+	if i < 0 {
+		return nil, nil
+	}
+
+	if len(entries[i].body) < mp4AudioEntrySize {
+		return nil, fmt.Errorf("%w: fLaC sample entry truncated", ErrInvalidMP4)
+	}
+
+	dfLa, err := mp4Child(entries[i].body[mp4AudioEntrySize:], "dfLa")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dfLa) < mp4FullBoxSize || dfLa[0] != 0 {
+		return nil, fmt.Errorf("%w: unsupported dfLa box", ErrInvalidMP4)
+	}
+
+	return dfLa[mp4FullBoxSize:], nil
+}
+
+// mp4Timescale returns the time units per second of the track's sample
+// durations, from its media header.
+func mp4Timescale(trak []byte) (uint32, error) {
+	mdhd, err := mp4Child(trak, "mdia", "mdhd")
+	if err != nil {
+		return 0, err
+	}
+
+	// Version 1 widens the creation and modification times to 64 bits.
+	pos := mp4FullBoxSize + 4 + 4
+	if len(mdhd) > 0 && mdhd[0] == 1 {
+		pos = mp4FullBoxSize + 8 + 8
+	}
+
+	if len(mdhd) < pos+4 || binary.BigEndian.Uint32(mdhd[pos:]) == 0 {
+		return 0, fmt.Errorf("%w: bad mdhd box", ErrInvalidMP4)
+	}
+
+	return binary.BigEndian.Uint32(mdhd[pos:]), nil
+}
+
+// readMP4Tables walks the sample tables in stbl: sizes from stsz or stz2,
+// file offsets from stsc and stco or co64, and first PCM samples from stts,
+// whose durations count timescale units.
+func readMP4Tables(stbl []byte, timescale, sampleRate uint32) (*mp4Track, error) {
+	sizes, err := mp4SampleSizes(stbl)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := mp4SampleOffsets(stbl, sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	stts, err := mp4Child(stbl, "stts")
+	if err != nil {
+		return nil, err
+	}
+
+	count, entries, err := mp4Table(stts, "stts", 8)
+	if err != nil {
+		return nil, err
+	}
+
+	starts := make([]uint64, 0, len(sizes)+1)
+
+	var elapsed uint64
+
+	for i := range count {
+		n, delta := binary.BigEndian.Uint32(entries[8*i:]), binary.BigEndian.Uint32(entries[8*i+4:])
+		for range n {
+			if len(starts) == len(sizes) {
+				return nil, fmt.Errorf("%w: stts covers more samples than stsz", ErrInvalidMP4)
+			}
+
+			starts = append(starts, elapsed*uint64(sampleRate)/uint64(timescale))
+			elapsed += uint64(delta)
+		}
+	}
+
+	if len(starts) != len(sizes) {
+		return nil, fmt.Errorf("%w: stts covers %d of %d samples", ErrInvalidMP4, len(starts), len(sizes))
+	}
+
+	starts = append(starts, elapsed*uint64(sampleRate)/uint64(timescale))
+
+	return &mp4Track{offsets: offsets, sizes: sizes, starts: starts}, nil
+}
+
+// mp4SampleSizes returns the size of every sample, from stsz or its compact
+// form stz2.
+func mp4SampleSizes(stbl []byte) ([]uint32, error) {
+	if stsz, err := mp4Child(stbl, "stsz"); err == nil {
+		if len(stsz) < mp4FullBoxSize+8 {
+			return nil, fmt.Errorf("%w: stsz box truncated", ErrInvalidMP4)
+		}
+
+		// A non-zero size applies to every sample, which then has no entry.
+		size := binary.BigEndian.Uint32(stsz[mp4FullBoxSize:])
+		if size != 0 {
+			count := binary.BigEndian.Uint32(stsz[mp4FullBoxSize+4:])
+			if count > mp4MaxSamples {
+				return nil, fmt.Errorf("%w: %d samples", ErrInvalidMP4, count)
+			}
+
+			return slices.Repeat([]uint32{size}, int(count)), nil
+		}
+
+		// Past the default size, the box is laid out as a table.
+		count, entries, err := mp4Table(stsz[4:], "stsz", 4)
+		if err != nil {
+			return nil, err
+		}
+
+		sizes := make([]uint32, count)
+		for i := range sizes {
+			sizes[i] = binary.BigEndian.Uint32(entries[4*i:])
+		}
+
+		return sizes, nil
+	}
+
+	stz2, err := mp4Child(stbl, "stz2")
+	if err != nil {
+		return nil, fmt.Errorf("%w: no stsz or stz2 box", ErrInvalidMP4)
+	}
+
+	if len(stz2) < mp4FullBoxSize+8 {
+		return nil, fmt.Errorf("%w: stz2 box truncated", ErrInvalidMP4)
+	}
+
+	// Reserved bytes then the field size, in bits, where stsz has its default.
+	bits := int(stz2[mp4FullBoxSize+3])
+	if bits != 4 && bits != 8 && bits != 16 {
+		return nil, fmt.Errorf("%w: stz2 field size %d", ErrInvalidMP4, bits)
+	}
+
+	// Past the field size, the box is laid out as a table, of packed entries.
+	count, entries, err := mp4Table(stz2[4:], "stz2", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) < (count*bits+7)/8 {
+		return nil, fmt.Errorf("%w: stz2 table truncated", ErrInvalidMP4)
+	}
+
+	sizes := make([]uint32, count)
+
+	for i := range sizes {
+		switch bits {
+		case 4:
+			sizes[i] = uint32(entries[i/2]>>(4*(1-i%2))) & 0x0F
+		case 8:
+			sizes[i] = uint32(entries[i])
+		default:
+			sizes[i] = uint32(binary.BigEndian.Uint16(entries[2*i:]))
+		}
+	}
+
+	return sizes, nil
+}
+
+// mp4SampleOffsets returns the file offset of every sample: stsc groups the
+// samples into chunks, stored back to back from the chunk offsets of stco or
+// its 64-bit form co64.
+func mp4SampleOffsets(stbl []byte, sizes []uint32) ([]int64, error) {
+	var chunks []int64
+
+	if stco, err := mp4Child(stbl, "stco"); err == nil {
+		count, entries, err := mp4Table(stco, "stco", 4)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range count {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(entries[4*i:])))
+		}
+	} else if co64, err := mp4Child(stbl, "co64"); err == nil {
+		count, entries, err := mp4Table(co64, "co64", 8)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range count {
+			offset := binary.BigEndian.Uint64(entries[8*i:])
+			chunks = append(chunks, int64(offset)) //nolint:gosec // Bounded by the file size.
+		}
+	} else {
+		return nil, fmt.Errorf("%w: no stco or co64 box", ErrInvalidMP4)
+	}
+
+	stsc, err := mp4Child(stbl, "stsc")
+	if err != nil {
+		return nil, err
+	}
+
+	count, entries, err := mp4Table(stsc, "stsc", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int64, 0, len(sizes))
+
+	for i := range count {
+		// Entries hold the first of a run of chunks, numbered from 1, which
+		// lasts until the next entry's.
+		first, perChunk := int(binary.BigEndian.Uint32(entries[12*i:])), binary.BigEndian.Uint32(entries[12*i+4:])
+
+		last := len(chunks)
+		if i+1 < count {
+			last = int(binary.BigEndian.Uint32(entries[12*(i+1):])) - 1
+		}
+
+		if first < 1 || last > len(chunks) {
+			return nil, fmt.Errorf("%w: stsc refers to chunks %d to %d of %d", ErrInvalidMP4, first, last, len(chunks))
+		}
+
+		for chunk := first; chunk <= last; chunk++ {
+			offset := chunks[chunk-1]
+
+			for range perChunk {
+				if len(offsets) == len(sizes) {
+					return nil, fmt.Errorf("%w: stsc covers more samples than stsz", ErrInvalidMP4)
+				}
+
+				offsets = append(offsets, offset)
+				offset += int64(sizes[len(offsets)-1])
+			}
+		}
+	}
+
+	if len(offsets) != len(sizes) {
+		return nil, fmt.Errorf("%w: stsc covers %d of %d samples", ErrInvalidMP4, len(offsets), len(sizes))
+	}
+
+	return offsets, nil
+}
+
+// mp4Table returns the entry count and the entries of a full box laid out as
+// a table: version and flags, a 32-bit count, then count entries of size
+// bytes each.
+func mp4Table(body []byte, typ string, size int) (int, []byte, error) {
+	if len(body) < mp4FullBoxSize+4 {
+		return 0, nil, fmt.Errorf("%w: %s box truncated", ErrInvalidMP4, typ)
+	}
+
+	count := binary.BigEndian.Uint32(body[mp4FullBoxSize:])
+	entries := body[mp4FullBoxSize+4:]
+
+	if count > mp4MaxSamples || int(count)*size > len(entries) {
+		return 0, nil, fmt.Errorf("%w: %s table of %d entries truncated", ErrInvalidMP4, typ, count)
+	}
+
+	return int(count), entries, nil
+}
+
+// mp4Child returns the body of the box found by following path down from
+// data, taking the first box of each type.
+func mp4Child(data []byte, path ...string) ([]byte, error) {
+	for _, typ := range path {
+		boxes, err := mp4Boxes(data)
+		if err != nil {
+			return nil, err
+		}
+
+		i := slices.IndexFunc(boxes, func(box mp4Box) bool { return box.typ == typ })
+		if i < 0 {
+			return nil, fmt.Errorf("%w: no %s box", ErrInvalidMP4, typ)
+		}
+
+		data = boxes[i].body
+	}
+
+	return data, nil
+}
+
+// mp4Boxes splits data into the boxes it holds.
+func mp4Boxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+
+	for len(data) > 0 {
+		if len(data) < mp4BoxHeaderSize {
+			return nil, fmt.Errorf("%w: box header truncated", ErrInvalidMP4)
+		}
+
+		typ := string(data[4:mp4BoxHeaderSize])
+		size, headerSize := uint64(binary.BigEndian.Uint32(data)), uint64(mp4BoxHeaderSize)
+
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < mp4BoxHeaderSize+8 {
+				return nil, fmt.Errorf("%w: box header truncated", ErrInvalidMP4)
+			}
+
+			size, headerSize = binary.BigEndian.Uint64(data[mp4BoxHeaderSize:]), mp4BoxHeaderSize+8
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: %q box of %d bytes overruns its parent", ErrInvalidMP4, typ, size)
+		}
+
+		boxes = append(boxes, mp4Box{typ: typ, body: data[headerSize:size]})
+		data = data[size:]
+	}
+
+	return boxes, nil
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"errors"
+	"io"
+)
+
+// NewMP4Decoder returns a decoder for FLAC in MP4 (.mp4, .m4a), as recorded by
+// Android and Apple devices. The first FLAC track is decoded: its STREAMINFO
+// and other metadata blocks come from the dfLa box, its frames from the sample
+// tables, which SeekSample also looks the target up in. Fragmented files, and
+// files without a FLAC track, fail with ErrInvalidMP4. Only the VerifyMD5
+// option is used. The caller should call Close when done.
+func NewMP4Decoder(rs io.ReadSeeker, opts ...DecoderOptions) (*Decoder, error) {
+	header, track, err := readMP4(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts) > 0 {
+		opts = []DecoderOptions{{VerifyMD5: opts[0].VerifyMD5}}
+	}
+
+	// Frames are not contiguous in the file: seeks go through the track instead.
+	dec, err := newDecoder(rs, &mp4Frames{r: rs, track: track}, header, -1, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.track = track
+
+	return dec, nil
+}
+
+// mp4Frames reads the samples of an MP4 FLAC track back to back, from sample
+// next on. Each sample holds one frame, so this is the native frame sequence.
+type mp4Frames struct {
+	r     io.ReadSeeker
+	track *mp4Track
+	next  int
+	// Bytes of the current sample left to read.
+	rest int64
+}
+
+// Read implements io.Reader.
+func (f *mp4Frames) Read(p []byte) (int, error) {
+	for f.rest == 0 {
+		if f.next == len(f.track.offsets) {
+			return 0, io.EOF
+		}
+
+		if _, err := f.r.Seek(f.track.offsets[f.next], io.SeekStart); err != nil {
+			return 0, err //nolint:wrapcheck // Surfaces wrapped by the decoder.
+		}
+
+		f.rest = int64(f.track.sizes[f.next])
+		f.next++
+	}
+
+	n, err := f.r.Read(p[:min(int64(len(p)), f.rest)])
+	f.rest -= int64(n)
+
+	if errors.Is(err, io.EOF) {
+		if f.rest > 0 {
+			// The file ends within the sample.
+			return n, io.ErrUnexpectedEOF
+		}
+
+		err = nil
+	}
+
+	return n, err //nolint:wrapcheck // Surfaces wrapped by the decoder.
+}
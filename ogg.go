@@ -0,0 +1,292 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ErrInvalidOgg is returned when an Ogg stream is malformed: bad capture
+// pattern or version, page CRC mismatch, missing pages or no FLAC stream.
+var ErrInvalidOgg = errors.New("invalid Ogg stream")
+
+const (
+	// oggHeaderSize is the fixed part of a page header, before the lacing values.
+	oggHeaderSize = 27
+	// oggCRCOffset locates the page checksum within the page header.
+	oggCRCOffset = 22
+	// oggMaxSegment is the lacing value of a segment continued by the next one.
+	oggMaxSegment = 255
+
+	// Page header flags.
+	oggContinued = 0x01
+	oggBOS       = 0x02
+	oggEOS       = 0x04
+
+	oggCRCPoly = 0x04C11DB7
+)
+
+//nolint:gochecknoglobals
+var (
+	oggCapture   = []byte("OggS")
+	oggCRCTable  = makeOggCRCTable()
+	oggFLACMagic = []byte("\x7fFLAC")
+)
+
+func makeOggCRCTable() [256]uint32 {
+	var table [256]uint32
+
+	for i := range table {
+		crc := uint32(i) << 24 //nolint:gosec // i < 256.
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ oggCRCPoly
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}
+
+// oggCRC updates the page checksum (polynomial 0x04C11DB7, unreflected, no
+// final XOR) with data.
+func oggCRC(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// oggPage is one Ogg page. Its slices are reused by the next readOggPage.
+type oggPage struct {
+	flags byte
+	// Position of the last sample completed on the page; -1 when no packet ends on it.
+	granule int64
+	serial  uint32
+	seq     uint32
+	lacing  []byte
+	data    []byte
+}
+
+// readOggPage reads and checks the page at the start of r into page. It
+// returns io.EOF when r ends before the page starts, io.ErrUnexpectedEOF when
+// it ends within.
+func readOggPage(r io.Reader, page *oggPage) error {
+	var hdr [oggHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err //nolint:wrapcheck // io.EOF and read failures pass through.
+	}
+
+	if !bytes.Equal(hdr[:len(oggCapture)], oggCapture) || hdr[4] != 0 {
+		return fmt.Errorf("%w: bad page header %q", ErrInvalidOgg, hdr[:5])
+	}
+
+	page.flags = hdr[5]
+	page.granule = int64(binary.LittleEndian.Uint64(hdr[6:])) //nolint:gosec // -1 is the "no packet ends" marker.
+	page.serial = binary.LittleEndian.Uint32(hdr[14:])
+	page.seq = binary.LittleEndian.Uint32(hdr[18:])
+	want := binary.LittleEndian.Uint32(hdr[oggCRCOffset:])
+
+	page.lacing = slices.Grow(page.lacing[:0], int(hdr[26]))[:hdr[26]]
+	if _, err := io.ReadFull(r, page.lacing); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	size := 0
+	for _, l := range page.lacing {
+		size += int(l)
+	}
+
+	page.data = slices.Grow(page.data[:0], size)[:size]
+	if _, err := io.ReadFull(r, page.data); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	clear(hdr[oggCRCOffset : oggCRCOffset+4])
+
+	if got := oggCRC(oggCRC(oggCRC(0, hdr[:]), page.lacing), page.data); got != want {
+		return fmt.Errorf("%w: page %d CRC mismatch; expected 0x%08X, got 0x%08X", ErrInvalidOgg, page.seq, want, got)
+	}
+
+	return nil
+}
+
+// oggPackets reassembles the packets of the first FLAC logical stream of an
+// Ogg physical stream, skipping any other multiplexed stream, then of the
+// FLAC streams chained after it.
+type oggPackets struct {
+	r    io.Reader
+	page oggPage
+	// Next lacing value and data offset of page to consume.
+	seg, off int
+	// Packet being reassembled, possibly across pages.
+	packet []byte
+	open   bool
+
+	serial  uint32
+	seq     uint32
+	started bool
+	eos     bool
+	// grouping reports that no page but BOS ones has been read since the link
+	// started: streams multiplexed with it start there, and a later BOS page
+	// starts the next link.
+	grouping bool
+	// held reports that page is the BOS page of the next link, read before the
+	// current link ended.
+	held bool
+	// Number of links that ended, when the stream is chained.
+	links int
+}
+
+// next returns the next packet, valid until the following call, or io.EOF
+// after the end-of-stream page of the current link.
+func (p *oggPackets) next() ([]byte, error) {
+	if !p.open {
+		p.packet = p.packet[:0]
+	}
+
+	for {
+		for p.seg < len(p.page.lacing) {
+			l := int(p.page.lacing[p.seg])
+			p.packet = append(p.packet, p.page.data[p.off:p.off+l]...)
+			p.seg++
+			p.off += l
+
+			if p.open = l == oggMaxSegment; !p.open {
+				return p.packet, nil
+			}
+		}
+
+		if p.eos {
+			return nil, io.EOF
+		}
+
+		if err := p.nextPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextPage reads the next page of the stream. A physical stream that ends
+// between pages ends the logical stream too, as when a live source is cut, and
+// so does the BOS page of a new FLAC stream past the group of BOS pages every
+// Ogg stream starts with, which is held for nextLink.
+func (p *oggPackets) nextPage() error {
+	for {
+		var err error
+		if p.held {
+			p.held = false
+		} else {
+			err = readOggPage(p.r, &p.page)
+		}
+
+		switch {
+		case errors.Is(err, io.EOF) && !p.started && p.links > 0:
+			return io.EOF
+		case errors.Is(err, io.EOF) && !p.started:
+			return fmt.Errorf("%w: no FLAC stream", ErrInvalidOgg)
+		case errors.Is(err, io.EOF):
+			p.eos = true
+
+			return io.EOF
+		case err != nil:
+			return err
+		}
+
+		if !p.started {
+			if p.page.flags&oggBOS == 0 || !bytes.HasPrefix(p.page.data, oggFLACMagic) {
+				continue
+			}
+
+			p.serial, p.started, p.grouping = p.page.serial, true, true
+		} else {
+			bos := p.page.flags&oggBOS != 0
+
+			p.grouping = p.grouping && bos
+			if bos && !p.grouping && bytes.HasPrefix(p.page.data, oggFLACMagic) {
+				p.seg, p.eos, p.held = len(p.page.lacing), true, true
+
+				return io.EOF
+			}
+
+			if p.page.serial != p.serial {
+				continue
+			}
+
+			if p.page.seq != p.seq+1 {
+				return fmt.Errorf("%w: page %d missing", ErrInvalidOgg, p.seq+1)
+			}
+		}
+
+		if p.open != (p.page.flags&oggContinued != 0) {
+			return fmt.Errorf("%w: page %d breaks packet continuity", ErrInvalidOgg, p.page.seq)
+		}
+
+		p.seq, p.seg, p.off = p.page.seq, 0, 0
+		p.eos = p.page.flags&oggEOS != 0
+
+		return nil
+	}
+}
+
+// nextLink moves past the end of the current link, so that next returns the
+// packets of the following FLAC stream, which starts with a new BOS page,
+// possibly held already. Packets left in the current link are dropped.
+func (p *oggPackets) nextLink() {
+	p.seg, p.packet = len(p.page.lacing), p.packet[:0]
+	p.open, p.started, p.eos = false, false, false
+	p.links++
+}
+
+// unexpectedEOF reports a stream ending within a page as io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// appendOggPage appends a page holding the given segments to dst, checksum
+// included.
+func appendOggPage(dst []byte, flags byte, granule int64, serial, seq uint32, lacing, data []byte) []byte {
+	start := len(dst)
+
+	dst = append(dst, oggCapture...)
+	dst = append(dst, 0, flags)
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(granule)) //nolint:gosec // -1 is the "no packet ends" marker.
+	dst = binary.LittleEndian.AppendUint32(dst, serial)
+	dst = binary.LittleEndian.AppendUint32(dst, seq)
+	dst = binary.LittleEndian.AppendUint32(dst, 0)
+	dst = append(dst, byte(len(lacing)))
+	dst = append(dst, lacing...)
+	dst = append(dst, data...)
+
+	binary.LittleEndian.PutUint32(dst[start+oggCRCOffset:], oggCRC(0, dst[start:]))
+
+	return dst
+}
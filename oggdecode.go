@@ -0,0 +1,159 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// oggMappingSize is the FLAC-in-Ogg mapping header that opens the first
+	// packet: magic, mapping version and number of header packets.
+	oggMappingSize = 5 + 2 + 2
+	// oggMappingMajor is the only mapping major version defined.
+	oggMappingMajor = 1
+)
+
+// NewOggDecoder returns a streaming decoder for FLAC in Ogg (.oga), reading r
+// strictly forward. The first FLAC logical stream is decoded; other streams
+// multiplexed with it are skipped. Page CRCs are checked, and malformed pages
+// fail with ErrInvalidOgg. As with NewStreamDecoder, seeking fails with
+// ErrNotSeekable, only the VerifyMD5 option is used, and Close closes r when
+// it is an io.Closer.
+//
+// Chained streams, such as internet radio starting a new logical stream per
+// track, decode link after link: Read returns ErrStreamChanged at each
+// boundary, where Format and Metadata switch to the new link. MD5
+// verification applies to every link on its own.
+func NewOggDecoder(r io.Reader, opts ...DecoderOptions) (*Decoder, error) {
+	packets := &oggPackets{r: r}
+
+	header, err := readOggHeader(packets)
+	if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%w: FLAC stream without packets", ErrInvalidOgg)
+	}
+
+	if err != nil {
+		closeSource(r)
+
+		return nil, err
+	}
+
+	if len(opts) > 0 {
+		opts = []DecoderOptions{{VerifyMD5: opts[0].VerifyMD5}}
+	}
+
+	dec, err := newDecoder(streamSource{r}, &oggFrames{packets: packets}, header, -1, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dec.nextLink = func() (*Decoder, error) {
+		packets.nextLink()
+
+		header, err := readOggHeader(packets)
+		if err != nil {
+			return nil, err
+		}
+
+		// The source stays with the decoder being switched: nothing to close here.
+		return newDecoder(streamSource{}, &oggFrames{packets: packets}, header, -1, opts)
+	}
+
+	return dec, nil
+}
+
+// readOggHeader parses the mapping header packet, which carries the signature
+// and STREAMINFO, and the header packets that follow, one metadata block each.
+func readOggHeader(packets *oggPackets) (*streamHeader, error) {
+	packet, err := packets.next()
+	if errors.Is(err, io.EOF) {
+		// No further link.
+		return nil, io.EOF
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	if len(packet) < oggMappingSize+signatureSize+blockHeaderSize+streamInfoSize ||
+		!bytes.HasPrefix(packet, oggFLACMagic) {
+		return nil, fmt.Errorf("%w: bad FLAC mapping header", ErrInvalidOgg)
+	}
+
+	if major := packet[len(oggFLACMagic)]; major != oggMappingMajor {
+		return nil, fmt.Errorf("%w: mapping version %d", ErrInvalidOgg, major)
+	}
+
+	// Zero means the number of header packets is unknown: the last one then
+	// carries the last-metadata-block flag.
+	count := int(binary.BigEndian.Uint16(packet[len(oggFLACMagic)+2:]))
+
+	native := bytes.Clone(packet[oggMappingSize:])
+	last := signatureSize
+
+	for i := 0; native[last]&0x80 == 0 && (count == 0 || i < count); i++ {
+		if packet, err = packets.next(); err != nil {
+			return nil, fmt.Errorf("%w: header packet %d: %w", ErrReadFailure, i+1, err)
+		}
+
+		if len(packet) < blockHeaderSize {
+			return nil, fmt.Errorf("%w: header packet %d is not a metadata block", ErrInvalidOgg, i+1)
+		}
+
+		last = len(native)
+		native = append(native, packet...)
+	}
+
+	// Encoders counting header packets may leave the flag unset.
+	native[last] |= 0x80
+
+	header, err := readStreamHeader(bytes.NewReader(native))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	return header, nil
+}
+
+// oggFrames reads the audio packets of an Ogg FLAC stream back to back. Each
+// packet holds one frame, so this is the native frame sequence.
+type oggFrames struct {
+	packets *oggPackets
+	buf     []byte
+}
+
+// Read implements io.Reader.
+func (f *oggFrames) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		packet, err := f.packets.next()
+		if err != nil {
+			return 0, err
+		}
+
+		f.buf = packet
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+
+	return n, nil
+}
@@ -0,0 +1,191 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+// oggPageTarget is the payload size past which an audio page is written out,
+// as libogg does.
+const oggPageTarget = 4096
+
+// OggOptions selects FLAC-in-Ogg (.oga) output.
+type OggOptions struct {
+	// Enabled wraps the stream in Ogg pages instead of writing native FLAC.
+	Enabled bool
+	// Serial is the serial number of the logical stream; 0 picks a random one,
+	// as flac --ogg does.
+	Serial uint32
+}
+
+// oggMuxer lays the FLAC-in-Ogg packets of one logical stream out in pages:
+// the mapping header and STREAMINFO alone on the first page, the other
+// metadata blocks on the next ones, then one packet per frame.
+type oggMuxer struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+	// First packet, kept to rewrite the first page when STREAMINFO is patched.
+	mapping []byte
+
+	// Page being filled.
+	lacing []byte
+	data   []byte
+	// Samples completed by the last packet ending on the page; -1 when none ends on it.
+	granule   int64
+	continued bool
+
+	// Frame being encoded, written out as a packet once complete.
+	packet bytes.Buffer
+	page   []byte
+}
+
+func newOggMuxer(w io.Writer, opts OggOptions) *oggMuxer {
+	serial := opts.Serial
+	for serial == 0 {
+		serial = rand.Uint32() //nolint:gosec // Serial numbers only tell streams apart.
+	}
+
+	return &oggMuxer{w: w, serial: serial, granule: -1}
+}
+
+// writeHeader writes the native stream header, signature and metadata
+// blocks, as the header packets.
+func (m *oggMuxer) writeHeader(header []byte) error {
+	pos := signatureSize + blockHeaderSize + streamInfoSize
+
+	var blocks [][]byte
+
+	for rest := header[pos:]; len(rest) > 0; {
+		size := blockHeaderSize + (int(rest[1])<<16 | int(rest[2])<<8 | int(rest[3]))
+		blocks = append(blocks, rest[:size])
+		rest = rest[size:]
+	}
+
+	m.mapping = append([]byte{}, oggFLACMagic...)
+	m.mapping = append(m.mapping, oggMappingMajor, 0)
+	m.mapping = binary.BigEndian.AppendUint16(m.mapping, uint16(len(blocks))) //nolint:gosec // Few blocks.
+	m.mapping = append(m.mapping, header[:pos]...)
+
+	if err := m.writePacket(m.mapping, 0); err != nil {
+		return err
+	}
+
+	if err := m.flush(0); err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		if err := m.writePacket(block, 0); err != nil {
+			return err
+		}
+	}
+
+	if len(m.lacing) == 0 {
+		return nil
+	}
+
+	// Audio starts on a fresh page.
+	return m.flush(0)
+}
+
+// writeFrame writes the frame buffered in packet, after which granule samples
+// are complete.
+func (m *oggMuxer) writeFrame(granule uint64) error {
+	defer m.packet.Reset()
+
+	if err := m.writePacket(m.packet.Bytes(), int64(granule)); err != nil { //nolint:gosec // Sample counts are 36-bit.
+		return err
+	}
+
+	if len(m.data) < oggPageTarget {
+		return nil
+	}
+
+	return m.flush(0)
+}
+
+// writePacket adds packet to the page, writing out pages as their 255 lacing
+// values fill up.
+func (m *oggMuxer) writePacket(packet []byte, granule int64) error {
+	for started := false; ; started = true {
+		if len(m.lacing) == oggMaxSegment {
+			if err := m.flush(0); err != nil {
+				return err
+			}
+
+			m.continued = started
+		}
+
+		n := min(len(packet), oggMaxSegment)
+		m.lacing = append(m.lacing, byte(n))
+		m.data = append(m.data, packet[:n]...)
+		packet = packet[n:]
+
+		if n < oggMaxSegment {
+			break
+		}
+	}
+
+	m.granule = granule
+
+	return nil
+}
+
+// flush writes out the page being filled, empty pages included.
+func (m *oggMuxer) flush(flags byte) error {
+	if m.continued {
+		flags |= oggContinued
+	}
+
+	if m.seq == 0 {
+		flags |= oggBOS
+	}
+
+	m.page = appendOggPage(m.page[:0], flags, m.granule, m.serial, m.seq, m.lacing, m.data)
+	if _, err := m.w.Write(m.page); err != nil {
+		return fmt.Errorf("writing Ogg page: %w", err)
+	}
+
+	m.seq++
+	m.lacing, m.data = m.lacing[:0], m.data[:0]
+	m.granule, m.continued = -1, false
+
+	return nil
+}
+
+// close writes the last page, flagged end-of-stream, after which total
+// samples are complete.
+func (m *oggMuxer) close(total uint64) error {
+	if len(m.lacing) == 0 {
+		m.granule = int64(total) //nolint:gosec // Sample counts are 36-bit.
+	}
+
+	return m.flush(oggEOS)
+}
+
+// firstPage returns the first page with its STREAMINFO body replaced by body.
+func (m *oggMuxer) firstPage(body []byte) []byte {
+	copy(m.mapping[oggMappingSize+signatureSize+blockHeaderSize:], body)
+
+	return appendOggPage(nil, oggBOS, 0, m.serial, 0, []byte{byte(len(m.mapping))}, m.mapping)
+}
@@ -0,0 +1,258 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrInvalidOptions is returned when EncoderOptions hold out-of-range values.
+var ErrInvalidOptions = errors.New("invalid encoder options")
+
+const (
+	// DefaultLevel is the compression level used when no EncoderOptions are given,
+	// matching the flac command line tool.
+	DefaultLevel = 5
+	// MaxLevel is the strongest compression preset.
+	MaxLevel = 8
+
+	// MinBlockSize and MaxBlockSize bound EncoderOptions.BlockSize. Only the last
+	// frame of a stream may be shorter than MinBlockSize.
+	MinBlockSize = 16
+	MaxBlockSize = 65535
+)
+
+// StereoMode selects how the encoder decorrelates two-channel input.
+type StereoMode int
+
+const (
+	// StereoIndependent codes left and right separately.
+	StereoIndependent StereoMode = iota
+	// StereoMidSide tries independent, left/side, side/right and mid/side
+	// coding on every frame and keeps the smallest (flac -m).
+	StereoMidSide
+	// StereoAdaptive runs the StereoMidSide search about every 0.4 seconds and
+	// reuses its choice for the frames in between (flac -M).
+	StereoAdaptive
+)
+
+// windowKind identifies an apodization function.
+type windowKind int
+
+const (
+	windowRectangle windowKind = iota
+	windowHann
+	windowTukey
+	windowPartialTukey
+	windowPunchoutTukey
+)
+
+// Window is an apodization function applied to a block before LPC analysis.
+// When several windows are configured, the encoder analyzes the block with
+// each one and keeps the cheapest predictor.
+type Window struct {
+	kind windowKind
+	// Tukey taper ratio.
+	ratio float64
+	// Number of sub-blocks for partial and punchout windows.
+	parts int
+}
+
+// Rectangle returns the rectangular (no-op) window.
+func Rectangle() Window {
+	return Window{kind: windowRectangle}
+}
+
+// Hann returns the Hann window.
+func Hann() Window {
+	return Window{kind: windowHann}
+}
+
+// Tukey returns a Tukey window whose tapered portion is ratio of the block:
+// 0 is rectangular and 1 is a Hann window.
+func Tukey(ratio float64) Window {
+	return Window{kind: windowTukey, ratio: ratio}
+}
+
+// PartialTukey returns a window set that analyzes each of parts equal
+// sub-blocks on its own, as flac's partial_tukey(parts).
+func PartialTukey(parts int) Window {
+	return Window{kind: windowPartialTukey, ratio: defaultTukeyP, parts: parts}
+}
+
+// PunchoutTukey returns a window set that analyzes the block with each of parts
+// equal sub-blocks masked out, as flac's punchout_tukey(parts).
+func PunchoutTukey(parts int) Window {
+	return Window{kind: windowPunchoutTukey, ratio: defaultTukeyP, parts: parts}
+}
+
+// SubdivideTukey returns the windows of flac's subdivide_tukey(parts): a Tukey
+// window over the whole block plus partial and punchout windows for every
+// subdivision from 2 up to parts.
+func SubdivideTukey(parts int) []Window {
+	windows := []Window{Tukey(defaultTukeyP)}
+	for n := 2; n <= parts; n++ {
+		windows = append(windows, PartialTukey(n), PunchoutTukey(n))
+	}
+
+	return windows
+}
+
+// EncoderOptions tunes the speed/size trade-off of the encoder. Fields left at
+// zero select the fastest behavior (fixed predictors only, a single Rice
+// partition, independent stereo); start from Level to get a balanced preset
+// and adjust individual fields from there.
+type EncoderOptions struct {
+	// BlockSize is the number of samples per channel in each frame; 0 selects 4096.
+	// The streamable subset allows at most 4608 (16384 above 48 kHz).
+	BlockSize int
+	// MaxLPCOrder is the highest LPC order to consider; 0 disables LPC. The
+	// streamable subset allows at most MaxLPCOrderSubset (32 above 48 kHz).
+	MaxLPCOrder int
+	// QLPPrecision is the quantized coefficient precision in bits (5-15); 0
+	// picks one from the bit depth and block size.
+	QLPPrecision int
+	// PrecisionSearch tries every coefficient precision (flac -p).
+	PrecisionSearch bool
+	// MinPartitionOrder and MaxPartitionOrder bound the Rice partition order
+	// search (0-15, flac -r min,max).
+	MinPartitionOrder int
+	MaxPartitionOrder int
+	// StereoMode selects inter-channel decorrelation for stereo input.
+	StereoMode StereoMode
+	// Apodization lists the windows tried for LPC analysis; nil selects Tukey(0.5).
+	Apodization []Window
+	// Exhaustive tries every LPC order up to MaxLPCOrder instead of the one
+	// estimated from the prediction error (flac -e).
+	Exhaustive bool
+
+	// Vendor and Tags are written as a VORBIS_COMMENT block when either is
+	// set; an empty Vendor then selects defaultVendor.
+	Vendor string
+	Tags   []Tag
+	// CueSheet is written as a CUESHEET block, as flac --cuesheet does;
+	// CueFile.CueSheet builds one from a .cue file.
+	CueSheet *CueSheet
+	// Pictures are written as PICTURE blocks, in order.
+	Pictures []*Picture
+	// Padding is the length of a trailing PADDING block, leaving room for
+	// later metadata edits; 0 writes none.
+	Padding int
+	// SeekTable reserves a SEEKTABLE right after STREAMINFO, filled with frame
+	// offsets on Close when the destination can seek and left as placeholders
+	// otherwise. The zero value writes none. Ogg streams cannot carry one.
+	SeekTable SeekTableOptions
+	// Ogg wraps the stream in Ogg pages; the zero value writes native FLAC.
+	Ogg OggOptions
+}
+
+// Level returns the options of a libFLAC compression preset, from 0 (fastest)
+// to 8 (smallest). Levels outside that range are clamped.
+func Level(level int) EncoderOptions {
+	level = min(max(level, 0), MaxLevel)
+
+	opts := EncoderOptions{
+		BlockSize:         defaultBlockSize,
+		MaxLPCOrder:       defaultMaxLPCOrder,
+		MaxPartitionOrder: 6,
+		StereoMode:        StereoMidSide,
+		Apodization:       []Window{Tukey(defaultTukeyP)},
+	}
+
+	switch level {
+	case 0, 1, 2:
+		opts.BlockSize = 1152
+		opts.MaxLPCOrder = 0
+		opts.MaxPartitionOrder = 3
+		opts.StereoMode = [...]StereoMode{StereoIndependent, StereoAdaptive, StereoMidSide}[level]
+	case 3:
+		opts.MaxLPCOrder = 6
+		opts.MaxPartitionOrder = 4
+		opts.StereoMode = StereoIndependent
+	case 4:
+		opts.MaxPartitionOrder = 4
+		opts.StereoMode = StereoAdaptive
+	case 5:
+		opts.MaxPartitionOrder = 5
+	case 6:
+		opts.Apodization = SubdivideTukey(2)
+	case 7:
+		opts.MaxLPCOrder = MaxLPCOrderSubset
+		opts.Apodization = SubdivideTukey(2)
+	case MaxLevel:
+		opts.MaxLPCOrder = MaxLPCOrderSubset
+		opts.Apodization = SubdivideTukey(3)
+	}
+
+	return opts
+}
+
+// validate reports the first out-of-range field.
+func (o *EncoderOptions) validate() error {
+	switch {
+	case o.BlockSize != 0 && (o.BlockSize < MinBlockSize || o.BlockSize > MaxBlockSize):
+		return fmt.Errorf("%w: block size %d outside %d-%d", ErrInvalidOptions, o.BlockSize, MinBlockSize, MaxBlockSize)
+	case o.MaxLPCOrder < 0 || o.MaxLPCOrder > MaxLPCOrder:
+		return fmt.Errorf("%w: max LPC order %d outside 0-%d", ErrInvalidOptions, o.MaxLPCOrder, MaxLPCOrder)
+	case o.QLPPrecision != 0 && (o.QLPPrecision < minQLPPrecision || o.QLPPrecision > maxQLPPrecision):
+		return fmt.Errorf("%w: QLP precision %d outside %d-%d",
+			ErrInvalidOptions, o.QLPPrecision, minQLPPrecision, maxQLPPrecision)
+	case o.MinPartitionOrder < 0 || o.MaxPartitionOrder > MaxPartitionOrder ||
+		o.MinPartitionOrder > o.MaxPartitionOrder:
+		return fmt.Errorf("%w: partition orders %d-%d outside 0-%d",
+			ErrInvalidOptions, o.MinPartitionOrder, o.MaxPartitionOrder, MaxPartitionOrder)
+	case o.StereoMode < StereoIndependent || o.StereoMode > StereoAdaptive:
+		return fmt.Errorf("%w: stereo mode %d", ErrInvalidOptions, o.StereoMode)
+	}
+
+	if o.Padding < 0 || o.Padding > maxBlockLength {
+		return fmt.Errorf("%w: padding %d outside 0-%d", ErrInvalidOptions, o.Padding, maxBlockLength)
+	}
+
+	for _, tag := range o.Tags {
+		if !validTagName(tag.Name) {
+			return fmt.Errorf("%w: tag name %q", ErrInvalidOptions, tag.Name)
+		}
+	}
+
+	if o.CueSheet != nil {
+		if err := o.CueSheet.validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+		}
+	}
+
+	if o.Ogg.Enabled && o.SeekTable.enabled() {
+		return fmt.Errorf("%w: seek table in an Ogg stream", ErrInvalidOptions)
+	}
+
+	if slices.Contains(o.Pictures, nil) {
+		return fmt.Errorf("%w: nil picture", ErrInvalidOptions)
+	}
+
+	for _, window := range o.Apodization {
+		switch {
+		case window.kind == windowTukey && (window.ratio < 0 || window.ratio > 1):
+			return fmt.Errorf("%w: tukey ratio %g outside 0-1", ErrInvalidOptions, window.ratio)
+		case (window.kind == windowPartialTukey || window.kind == windowPunchoutTukey) && window.parts < 1:
+			return fmt.Errorf("%w: window with %d parts", ErrInvalidOptions, window.parts)
+		}
+	}
+
+	return nil
+}
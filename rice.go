@@ -0,0 +1,248 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"math/bits"
+
+	"github.com/mewkiz/flac/frame"
+)
+
+const (
+	// MaxPartitionOrder is the highest Rice partition order the FLAC format can express.
+	MaxPartitionOrder = 15
+
+	// Rice1 uses a 4-bit parameter (15 is the escape code), Rice2 a 5-bit one (31 is the escape code).
+	riceParamBits  = 4
+	rice2ParamBits = 5
+	maxRiceParam   = 14
+	maxRice2Param  = 30
+	riceEscape     = 1<<riceParamBits - 1
+	rice2Escape    = 1<<rice2ParamBits - 1
+
+	// Escaped partitions store their sample width in a 5-bit field.
+	escapeBitsField = 5
+	maxEscapeBits   = 1<<escapeBitsField - 1
+
+	// 2 bits residual coding method + 4 bits partition order.
+	residualHeaderBits = 2 + 4
+)
+
+// riceSearch holds the per-partition statistics of the partition order search,
+// reused across candidates.
+type riceSearch struct {
+	// Sum and maximum of the zigzag-folded residuals of each partition.
+	sums  []uint64
+	maxes []uint64
+	// Partition choices for the order being evaluated and the best one so far.
+	current []frame.RicePartition
+	best    []frame.RicePartition
+}
+
+// planResidual picks the partition order, coding method and per-partition Rice
+// parameters (or escapes) for the residuals of a subframe whose predictor has
+// the given order. The returned size covers the whole residual section.
+func (p *planner) planResidual(residuals []int32, blockSize, predOrder int) (
+	frame.ResidualCodingMethod, *frame.RiceSubframe, uint64,
+) {
+	search := &p.rice
+
+	top := min(p.maxPartitionOrder, MaxPartitionOrder)
+	for top > 0 && (blockSize%(1<<top) != 0 || blockSize>>top <= predOrder) {
+		top--
+	}
+
+	bottom := min(p.minPartitionOrder, top)
+
+	search.collect(residuals, blockSize, predOrder, top)
+
+	var (
+		bestOrder  int
+		bestMethod frame.ResidualCodingMethod
+		bestBits   uint64
+		found      bool
+	)
+
+	for order := top; order >= bottom; order-- {
+		method, partBits := search.evaluate(blockSize, predOrder, order)
+		if !found || partBits < bestBits {
+			bestOrder, bestMethod, bestBits, found = order, method, partBits, true
+			search.current, search.best = search.best, search.current
+		}
+
+		search.merge()
+	}
+
+	return bestMethod, &frame.RiceSubframe{
+		PartOrder:  bestOrder,
+		Partitions: append([]frame.RicePartition(nil), search.best[:1<<bestOrder]...),
+	}, residualHeaderBits + bestBits
+}
+
+// collect computes the folded sum and maximum of every partition at the given order.
+func (s *riceSearch) collect(residuals []int32, blockSize, predOrder, order int) {
+	nParts := 1 << order
+	if cap(s.sums) < nParts {
+		s.sums = make([]uint64, nParts)
+		s.maxes = make([]uint64, nParts)
+		s.current = make([]frame.RicePartition, nParts)
+		s.best = make([]frame.RicePartition, nParts)
+	}
+
+	s.sums = s.sums[:nParts]
+	s.maxes = s.maxes[:nParts]
+	s.current = s.current[:nParts]
+	s.best = s.best[:nParts]
+
+	partSize := blockSize >> order
+	// The first partition is short by the predictor order (warm-up samples are not residuals).
+	start := 0
+
+	for part := range nParts {
+		end := (part+1)*partSize - predOrder
+
+		var sum, peak uint64
+
+		for _, residual := range residuals[start:end] {
+			folded := zigzag(int64(residual))
+			sum += folded
+			peak = max(peak, folded)
+		}
+
+		s.sums[part] = sum
+		s.maxes[part] = peak
+		start = end
+	}
+}
+
+// merge folds adjacent partitions pairwise, moving the statistics one order down.
+func (s *riceSearch) merge() {
+	half := len(s.sums) / 2
+	for part := range half {
+		s.sums[part] = s.sums[2*part] + s.sums[2*part+1]
+		s.maxes[part] = max(s.maxes[2*part], s.maxes[2*part+1])
+	}
+
+	s.sums = s.sums[:max(half, 1)]
+	s.maxes = s.maxes[:max(half, 1)]
+}
+
+// evaluate chooses parameters for every partition at the given order (whose
+// statistics must be current) under both coding methods, stores the cheaper
+// choice in s.current and returns its method and size.
+func (s *riceSearch) evaluate(blockSize, predOrder, order int) (frame.ResidualCodingMethod, uint64) {
+	nParts := 1 << order
+	partSize := blockSize >> order
+
+	var rice1Bits, rice2Bits uint64
+
+	needsRice2 := false
+
+	for part := range nParts {
+		count := partSize
+		if part == 0 {
+			count -= predOrder
+		}
+
+		param, escBits, partBits := partitionCost(s.sums[part], s.maxes[part], count, maxRice2Param)
+		rice2Bits += rice2ParamBits + partBits
+
+		if param > maxRiceParam && escBits == 0 {
+			// Rice1 cannot express this parameter; cost it with the best Rice1 choice instead.
+			needsRice2 = true
+			_, _, partBits = partitionCost(s.sums[part], s.maxes[part], count, maxRiceParam)
+		}
+
+		rice1Bits += riceParamBits + partBits
+		s.current[part] = frame.RicePartition{Param: param, EscapedBitsPerSample: escBits}
+	}
+
+	if needsRice2 && rice2Bits < rice1Bits {
+		for part := range nParts {
+			if s.current[part].EscapedBitsPerSample != 0 {
+				s.current[part].Param = rice2Escape
+			}
+		}
+
+		return frame.ResidualCodingMethodRice2, rice2Bits
+	}
+
+	// Rice1 is never larger when every parameter fits in 4 bits, so recompute its choices.
+	for part := range nParts {
+		count := partSize
+		if part == 0 {
+			count -= predOrder
+		}
+
+		param, escBits, _ := partitionCost(s.sums[part], s.maxes[part], count, maxRiceParam)
+		if escBits != 0 {
+			param = riceEscape
+		}
+
+		s.current[part] = frame.RicePartition{Param: param, EscapedBitsPerSample: escBits}
+	}
+
+	return frame.ResidualCodingMethodRice1, rice1Bits
+}
+
+// partitionCost returns the cheapest coding of count residuals with the given
+// folded sum and maximum: a Rice parameter up to maxParam, or an escape storing
+// every residual in escBits bits (escBits is 0 when Rice coding wins). The size
+// excludes the parameter field.
+func partitionCost(sum, peak uint64, count int, maxParam uint) (uint, uint, uint64) {
+	n := uint64(count) //nolint:gosec // Partition sizes are positive.
+
+	// The optimal parameter sits near log2 of the mean folded residual.
+	guess := uint(bits.Len64(sum / n))
+	low := uint(0)
+
+	if guess > 2 {
+		low = guess - 2
+	}
+
+	bestParam := min(low, maxParam)
+	bestBits := riceBits(sum, n, bestParam)
+
+	for param := low + 1; param <= min(guess+1, maxParam); param++ {
+		if b := riceBits(sum, n, param); b < bestBits {
+			bestParam, bestBits = param, b
+		}
+	}
+
+	// Escaped residuals are stored as two's complement; the folded maximum's
+	// length is exactly the signed width needed.
+	escBits := max(1, uint(bits.Len64(peak)))
+	if escBits <= maxEscapeBits {
+		if escaped := escapeBitsField + n*uint64(escBits); escaped < bestBits {
+			return 0, escBits, escaped
+		}
+	}
+
+	return bestParam, 0, bestBits
+}
+
+// riceBits estimates the size of n residuals with the given folded sum coded
+// with a Rice parameter. Each residual costs a unary quotient, a stop bit and
+// param low bits; the quotients are estimated from the sum, less the half bit
+// per residual that flooring drops on average.
+func riceBits(sum, n uint64, param uint) uint64 {
+	if param == 0 {
+		return n + sum
+	}
+
+	return n*uint64(param+1) + sum>>param - n/2
+}
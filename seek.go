@@ -0,0 +1,329 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrSeekOutOfRange is returned when seeking before the start or past the
+	// end of the stream.
+	ErrSeekOutOfRange = errors.New("seek position out of range")
+
+	// ErrNotSeekable is returned when seeking a decoder whose source cannot
+	// seek, or seeking relative to the end of a stream of unknown length.
+	ErrNotSeekable = errors.New("stream is not seekable")
+)
+
+const (
+	// Below this many samples between the bisection bounds, decoding forward
+	// is cheaper than probing for another frame.
+	linearSeekBlocks = 8
+	// scanChunkSize is how much of the source findFrame reads at a time.
+	scanChunkSize = 64 << 10
+)
+
+// seekBound is a frame start used to narrow a seek: its absolute offset in the
+// source and its first sample.
+type seekBound struct {
+	offset int64
+	sample uint64
+}
+
+// SeekSample positions the decoder so the next Read starts at inter-channel
+// sample n. It looks the frame up in the sample tables of MP4 sources, or in
+// DecoderOptions.Index when one was given, otherwise narrows the search with
+// the SEEKTABLE when present and bisects over frame headers, then decodes the
+// containing frame and discards the samples before n. Seeking to the total
+// sample count positions at EOF.
+//
+// Seeking stops MD5 verification, since the hash no longer covers the whole
+// stream. If a seek fails, later Reads return its error until a seek succeeds,
+// except on decoders that cannot seek at all: ErrNotSeekable leaves them
+// reading on from where they were.
+func (d *Decoder) SeekSample(n uint64) error {
+	if d.dataStart < 0 && d.track == nil {
+		return ErrNotSeekable
+	}
+
+	if err := d.seekSample(n); err != nil {
+		d.err = err
+		d.eof = false
+
+		return err
+	}
+
+	d.err = nil
+	d.pos = int64(n) * int64(d.nChannels*d.bytesPerSample) //nolint:gosec // Sample counts are 36-bit.
+
+	return nil
+}
+
+// Seek implements io.Seeker over the decoded PCM byte stream. Offsets that fall
+// inside a sample are honored by skipping the leading bytes of that sample.
+func (d *Decoder) Seek(offset int64, whence int) (int64, error) {
+	frameSize := int64(d.nChannels * d.bytesPerSample)
+
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = d.pos + offset
+	case io.SeekEnd:
+		if d.info.NSamples == 0 {
+			return d.pos, fmt.Errorf("%w: total length unknown", ErrNotSeekable)
+		}
+
+		abs = int64(d.info.NSamples)*frameSize + offset //nolint:gosec // Sample counts are 36-bit.
+	default:
+		return d.pos, fmt.Errorf("%w: invalid whence %d", ErrSeekOutOfRange, whence)
+	}
+
+	if abs < 0 {
+		return d.pos, fmt.Errorf("%w: offset %d", ErrSeekOutOfRange, abs)
+	}
+
+	if err := d.SeekSample(uint64(abs / frameSize)); err != nil {
+		return d.pos, err
+	}
+
+	d.bufOff += int(abs % frameSize)
+	d.pos = abs
+
+	return abs, nil
+}
+
+func (d *Decoder) seekSample(target uint64) error {
+	total := d.info.NSamples
+	if total != 0 && target > total {
+		return fmt.Errorf("%w: sample %d of %d", ErrSeekOutOfRange, target, total)
+	}
+
+	d.md5 = nil
+	d.buf = d.buf[:0]
+	d.bufOff = 0
+
+	if total != 0 && target == total {
+		d.eof = true
+
+		return nil
+	}
+
+	if d.track != nil {
+		i := d.track.frameAt(target)
+
+		return d.decodeFrom(target, &mp4Frames{r: d.source, track: d.track, next: i}, d.track.starts[i])
+	}
+
+	if d.index != nil {
+		return d.decodeTo(target, d.index.lookup(target, d.dataStart))
+	}
+
+	lower, upper, err := d.seekBounds(target)
+	if err != nil {
+		return err
+	}
+
+	if total != 0 {
+		if lower, err = d.bisect(target, lower, upper); err != nil {
+			return err
+		}
+	}
+
+	return d.decodeTo(target, lower)
+}
+
+// seekBounds returns the frame starts bracketing target: the stream start and
+// end, tightened by the SEEKTABLE when one is present. The upper bound's sample
+// is only meaningful when STREAMINFO records the total sample count.
+func (d *Decoder) seekBounds(target uint64) (seekBound, seekBound, error) {
+	end, err := d.source.Seek(0, io.SeekEnd)
+	if err != nil {
+		return seekBound{}, seekBound{}, fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	lower := seekBound{offset: d.dataStart}
+	upper := seekBound{offset: end, sample: d.info.NSamples}
+
+	if d.seekTable == nil {
+		return lower, upper, nil
+	}
+
+	for _, point := range d.seekTable.Points {
+		if point.Sample == PlaceholderSample {
+			continue
+		}
+
+		offset := d.dataStart + int64(point.Offset) //nolint:gosec // Offsets are bounded by the file size.
+		if offset >= end {
+			continue
+		}
+
+		switch {
+		case point.Sample <= target && point.Sample >= lower.sample:
+			lower = seekBound{offset: offset, sample: point.Sample}
+		case point.Sample > target && point.Sample < upper.sample:
+			upper = seekBound{offset: offset, sample: point.Sample}
+		}
+	}
+
+	return lower, upper, nil
+}
+
+// bisect narrows [lower, upper) around target by probing for frames at
+// interpolated offsets, and returns a frame start at or before target.
+func (d *Decoder) bisect(target uint64, lower, upper seekBound) (seekBound, error) {
+	span := uint64(linearSeekBlocks) * uint64(max(d.info.BlockSizeMax, 1))
+
+	for upper.sample-lower.sample > span && upper.offset-lower.offset > maxFrameHeaderSize {
+		// Assume a constant bitrate between the bounds.
+		ratio := float64(target-lower.sample) / float64(upper.sample-lower.sample)
+		guess := lower.offset + int64(ratio*float64(upper.offset-lower.offset))
+		guess = min(max(guess, lower.offset+1), upper.offset-1)
+
+		probe, found, err := d.findFrame(guess, upper.offset, lower.sample, upper.sample)
+		if err != nil {
+			return lower, err
+		}
+
+		switch {
+		case !found:
+			// The frame holding target starts before guess.
+			upper.offset = guess
+		case probe.sample <= target:
+			lower = probe
+		default:
+			upper = probe
+		}
+	}
+
+	return lower, nil
+}
+
+// findFrame returns the first frame starting in [from, limit) whose header is
+// valid, whose first sample lies in [minSample, maxSample) and which decodes
+// with a valid CRC-16.
+func (d *Decoder) findFrame(from, limit int64, minSample, maxSample uint64) (seekBound, bool, error) {
+	buf := make([]byte, scanChunkSize+maxFrameHeaderSize)
+
+	for pos := from; pos < limit; pos += scanChunkSize {
+		if _, err := d.source.Seek(pos, io.SeekStart); err != nil {
+			return seekBound{}, false, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+
+		n, err := io.ReadFull(d.source, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return seekBound{}, false, fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+
+		chunk := buf[:n]
+		scan := min(int64(len(chunk)), int64(scanChunkSize), limit-pos)
+
+		for i := range int(scan) {
+			if chunk[i] != frameSyncByte {
+				continue
+			}
+
+			hdr, ok := parseFrameHeader(chunk[i:], d.info)
+			if !ok || hdr.sampleNum < minSample || hdr.sampleNum >= maxSample {
+				continue
+			}
+
+			candidate := seekBound{offset: pos + int64(i), sample: hdr.sampleNum}
+			if d.frameDecodes(candidate.offset) {
+				return candidate, true, nil
+			}
+		}
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	return seekBound{}, false, nil
+}
+
+// frameDecodes reports whether a complete frame with a valid CRC-16 starts at
+// offset, weeding out false syncs whose header CRC-8 matched by chance.
+func (d *Decoder) frameDecodes(offset int64) bool {
+	if _, err := d.source.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+
+	stream, err := openFrames(d.preamble, d.source)
+	if err != nil {
+		return false
+	}
+
+	_, err = stream.ParseNext()
+
+	return err == nil
+}
+
+// decodeTo restarts decoding at the frame starting at from and decodes forward
+// to the frame holding target, leaving the samples before target skipped.
+func (d *Decoder) decodeTo(target uint64, from seekBound) error {
+	if _, err := d.source.Seek(from.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	return d.decodeFrom(target, d.source, from.sample)
+}
+
+// decodeFrom restarts decoding on frames, whose first frame starts at sample,
+// and decodes forward to the frame holding target.
+func (d *Decoder) decodeFrom(target uint64, frames io.Reader, sample uint64) error {
+	stream, err := openFrames(d.preamble, frames)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrReadFailure, err)
+	}
+
+	d.stream = stream
+	d.eof = false
+
+	for {
+		audioFrame, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			if sample == target {
+				d.eof = true
+
+				return nil
+			}
+
+			return fmt.Errorf("%w: sample %d past end of stream at %d", ErrSeekOutOfRange, target, sample)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrReadFailure, err)
+		}
+
+		next := sample + uint64(audioFrame.BlockSize)
+		if target < next {
+			d.fill(audioFrame)
+			d.bufOff = int(target-sample) * d.nChannels * d.bytesPerSample //nolint:gosec // Within one frame.
+
+			return nil
+		}
+
+		sample = next
+	}
+}
@@ -0,0 +1,228 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	// seekPointSize is the encoded length of a seek point.
+	seekPointSize = 8 + 8 + 2
+	// maxSeekPoints is the most points a SEEKTABLE block can hold.
+	maxSeekPoints = maxBlockLength / seekPointSize
+)
+
+// SeekTableOptions selects the seek points of a SEEKTABLE. The sources
+// combine; each requested sample resolves to the frame holding it, and points
+// falling in the same frame merge into one.
+type SeekTableOptions struct {
+	// Interval places a point every Interval of audio (flac -S 10s).
+	Interval time.Duration
+	// SampleInterval places a point every SampleInterval samples.
+	SampleInterval uint64
+	// Points places points at explicit sample numbers (flac -S #).
+	Points []uint64
+	// TotalSamples is the expected stream length in inter-channel samples. The
+	// streaming Encoder needs it to size interval-based tables up front; Encode
+	// knows the length of its input. Points past the actual end are left as
+	// placeholders.
+	TotalSamples uint64
+}
+
+// enabled reports whether any seek point is requested.
+func (o *SeekTableOptions) enabled() bool {
+	return o.Interval > 0 || o.SampleInterval > 0 || len(o.Points) > 0
+}
+
+// validate checks the options for a stream of total samples, 0 when unknown.
+func (o *SeekTableOptions) validate(total uint64) error {
+	switch {
+	case o.Interval < 0:
+		return fmt.Errorf("%w: negative seek table interval %v", ErrInvalidOptions, o.Interval)
+	case (o.Interval > 0 || o.SampleInterval > 0) && total == 0:
+		return fmt.Errorf("%w: seek table intervals need TotalSamples", ErrInvalidOptions)
+	case slices.Contains(o.Points, PlaceholderSample):
+		return fmt.Errorf("%w: placeholder sample in seek points", ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+// targets returns the sorted, deduplicated samples the options request in a
+// stream of total samples at sampleRate, capped at maxSeekPoints.
+func (o *SeekTableOptions) targets(sampleRate int, total uint64) []uint64 {
+	var targets []uint64
+
+	if o.Interval > 0 {
+		// Intervals shorter than a sample period place a point on every sample.
+		step := max(1, uint64(o.Interval.Seconds()*float64(sampleRate)))
+		targets = appendEvery(targets, step, total)
+	}
+
+	targets = appendEvery(targets, o.SampleInterval, total)
+	targets = append(targets, o.Points...)
+
+	slices.Sort(targets)
+	targets = slices.Compact(targets)
+
+	return targets[:min(len(targets), maxSeekPoints)]
+}
+
+// appendEvery appends every step-th sample below total, at most maxSeekPoints of them.
+func appendEvery(targets []uint64, step, total uint64) []uint64 {
+	if step == 0 {
+		return targets
+	}
+
+	for sample, n := uint64(0), 0; sample < total && n < maxSeekPoints; sample, n = sample+step, n+1 {
+		targets = append(targets, sample)
+	}
+
+	return targets
+}
+
+// seekRecorder resolves seek targets to frames as they are written.
+type seekRecorder struct {
+	// Remaining targets, sorted.
+	targets []uint64
+	points  []SeekPoint
+	// Number of points reserved in the stream header.
+	reserved int
+}
+
+// newSeekRecorder reserves a point per target.
+func newSeekRecorder(targets []uint64) *seekRecorder {
+	return &seekRecorder{targets: targets, reserved: len(targets)}
+}
+
+// frame records a frame starting at sample and offset bytes past the first
+// frame, resolving the targets it holds.
+func (r *seekRecorder) frame(sample, offset uint64, blockSize int) {
+	end := sample + uint64(blockSize) //nolint:gosec // Block sizes are positive.
+
+	// Frames arrive in order, so every remaining target is at or past sample.
+	hit := false
+	for len(r.targets) > 0 && r.targets[0] < end {
+		hit = true
+		r.targets = r.targets[1:]
+	}
+
+	if hit {
+		//nolint:gosec // Block sizes fit 16 bits.
+		r.points = append(r.points, SeekPoint{Sample: sample, Offset: offset, Samples: uint16(blockSize)})
+	}
+}
+
+// table returns the recorded points padded with placeholders to the reserved size.
+func (r *seekRecorder) table() *SeekTable {
+	return placeholderTable(r.points, r.reserved)
+}
+
+// placeholderTable returns points followed by placeholders up to size points.
+func placeholderTable(points []SeekPoint, size int) *SeekTable {
+	table := &SeekTable{Points: make([]SeekPoint, max(size, len(points)))}
+
+	copy(table.Points, points)
+
+	for i := len(points); i < len(table.Points); i++ {
+		table.Points[i] = SeekPoint{Sample: PlaceholderSample}
+	}
+
+	return table
+}
+
+// AddSeekTable scans the frames of the FLAC file at path and writes a SEEKTABLE
+// with the points opts requests, replacing any existing one, as metaflac
+// --add-seekpoint does. opts.TotalSamples is ignored: the scan measures the
+// stream. The table goes right after STREAMINFO and is written through
+// UpdateMetadata, in place when the padding can absorb it.
+func AddSeekTable(path string, opts SeekTableOptions) error {
+	if !opts.enabled() {
+		return fmt.Errorf("%w: no seek points requested", ErrInvalidOptions)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	header, index, err := buildIndex(bufio.NewReader(file))
+	_ = file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if err := opts.validate(index.samples); err != nil {
+		return err
+	}
+
+	recorder := newSeekRecorder(opts.targets(int(header.info.SampleRate), index.samples))
+	for _, entry := range index.entries {
+		recorder.frame(entry.sample, uint64(entry.offset), int(entry.blockSize)) //nolint:gosec // Offsets are positive.
+	}
+
+	md := header.metadata
+	md.RemoveBlocks(BlockSeekTable)
+	// Targets past the end of the stream resolve to nothing: keep only real points.
+	md.Blocks = slices.Insert(md.Blocks, 0, Block(&SeekTable{Points: recorder.points}))
+
+	return UpdateMetadata(path, md)
+}
+
+// seekBuffer is an in-memory io.WriteSeeker, letting Encode patch its header
+// on destinations that cannot seek.
+type seekBuffer struct {
+	buf []byte
+	pos int
+}
+
+func (b *seekBuffer) Write(p []byte) (int, error) {
+	if end := b.pos + len(p); end > len(b.buf) {
+		b.buf = append(b.buf, make([]byte, end-len(b.buf))...)
+	}
+
+	b.pos += copy(b.buf[b.pos:], p)
+
+	return len(p), nil
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(b.pos)
+	case io.SeekEnd:
+		offset += int64(len(b.buf))
+	default:
+		return 0, fmt.Errorf("%w: invalid whence %d", ErrSeekOutOfRange, whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("%w: offset %d", ErrSeekOutOfRange, offset)
+	}
+
+	b.pos = int(offset)
+
+	return offset, nil
+}
@@ -0,0 +1,252 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrNoCueSheet is returned when splitting a stream without a CUESHEET.
+var ErrNoCueSheet = errors.New("no cue sheet")
+
+// PregapMode selects where the pregap of a track, the audio between its
+// INDEX 00 and INDEX 01, goes when splitting.
+type PregapMode int
+
+const (
+	// PregapAppend appends each pregap to the end of the previous track, as
+	// most rippers do. The pregap of the first track (hidden track audio)
+	// stays in the first track. Splits are gapless.
+	PregapAppend PregapMode = iota
+	// PregapPrepend starts each track at its INDEX 00, so tracks open with
+	// their pregap. Splits are gapless.
+	PregapPrepend
+	// PregapDiscard drops pregaps: tracks run from INDEX 01 to the next
+	// track's INDEX 00.
+	PregapDiscard
+)
+
+// SplitOptions configures Decoder.Tracks and Decoder.Split.
+type SplitOptions struct {
+	Pregap PregapMode
+	// CueSheet replaces the stream's embedded CUESHEET, e.g. one converted
+	// from an external .cue file with CueFile.CueSheet.
+	CueSheet *CueSheet
+	// Cue supplies the album and track titles and performers for the tags.
+	Cue *CueFile
+}
+
+// SplitTrack is one audio track of a single-image stream.
+type SplitTrack struct {
+	Number uint8
+	// Start and End bound the track in samples; End is excluded.
+	Start, End uint64
+	// Tags are the Vorbis comments of the track: the stream's own, minus
+	// per-track ones (TITLE, TRACKNUMBER, ...), plus TRACKNUMBER, TRACKTOTAL,
+	// ISRC and the titles and performers of SplitOptions.Cue.
+	Tags []Tag
+}
+
+// perTrackTags are the stream tags that describe the image rather than a track.
+//
+//nolint:gochecknoglobals
+var perTrackTags = []string{"TITLE", "TRACKNUMBER", "TRACKTOTAL", "TOTALTRACKS", "ISRC", "CUESHEET"}
+
+// Tracks returns the audio tracks described by the stream's CUESHEET, or by
+// opts.CueSheet, in order. Data tracks are skipped. The last track ends at the
+// lead-out, capped to the stream length when known.
+func (d *Decoder) Tracks(opts SplitOptions) ([]SplitTrack, error) {
+	sheet := opts.CueSheet
+	if sheet == nil {
+		sheet = d.metadata.CueSheet()
+	}
+
+	if sheet == nil {
+		return nil, ErrNoCueSheet
+	}
+
+	if err := sheet.validate(); err != nil {
+		return nil, err
+	}
+
+	// Pregap and INDEX 01 positions of every track, the lead-out included.
+	type bounds struct{ pregap, start uint64 }
+
+	marks := make([]bounds, len(sheet.Tracks))
+
+	for i, track := range sheet.Tracks {
+		marks[i] = bounds{track.Offset, track.Offset}
+		if len(track.Indices) == 0 {
+			continue
+		}
+
+		marks[i].pregap += track.Indices[0].Offset
+
+		j := slices.IndexFunc(track.Indices, func(index CueIndex) bool { return index.Number == 1 })
+		if j < 0 {
+			return nil, fmt.Errorf("%w: track %d has no index 1", ErrInvalidCue, track.Number)
+		}
+
+		marks[i].start += track.Indices[j].Offset
+	}
+
+	end := sheet.Tracks[len(sheet.Tracks)-1].Offset
+	if d.info.NSamples != 0 {
+		end = min(end, d.info.NSamples)
+	}
+
+	base := baseTags(d.metadata.VorbisComment(), opts.Cue)
+	last := len(sheet.Tracks) - 1
+	tracks := make([]SplitTrack, 0, last)
+
+	for i, track := range sheet.Tracks[:last] {
+		if !track.IsAudio {
+			continue
+		}
+
+		var start, stop uint64
+
+		// The sheet's first track takes the audio before it, hidden track audio
+		// included; an audio track after a leading data track does not.
+		switch opts.Pregap {
+		case PregapAppend:
+			start, stop = marks[i].start, marks[i+1].start
+			if i == 0 {
+				start = 0
+			}
+		case PregapPrepend:
+			start, stop = marks[i].pregap, marks[i+1].pregap
+			if i == 0 {
+				start = 0
+			}
+		case PregapDiscard:
+			start, stop = marks[i].start, marks[i+1].pregap
+		default:
+			return nil, fmt.Errorf("%w: pregap mode %d", ErrInvalidCue, opts.Pregap)
+		}
+
+		if i+1 == last {
+			stop = end
+		}
+
+		tracks = append(tracks, SplitTrack{Number: track.Number, Start: start, End: max(start, min(stop, end))})
+	}
+
+	for i := range tracks {
+		tracks[i].Tags = trackTags(base, &tracks[i], len(tracks), sheet, opts.Cue)
+	}
+
+	return tracks, nil
+}
+
+// Split decodes the tracks returned by Tracks in order, handing each one's
+// PCM to emit, which must consume it before returning. The stream is decoded
+// strictly forward, gaps left by PregapDiscard being decoded and dropped, so
+// splitting works on decoders that cannot seek.
+func (d *Decoder) Split(opts SplitOptions, emit func(track SplitTrack, pcm io.Reader) error) error {
+	tracks, err := d.Tracks(opts)
+	if err != nil {
+		return err
+	}
+
+	frameSize := int64(d.nChannels * d.bytesPerSample)
+
+	for _, track := range tracks {
+		start := int64(track.Start) * frameSize //nolint:gosec // Sample counts are 36-bit.
+		if _, err := io.CopyN(io.Discard, d, start-d.pos); err != nil {
+			return fmt.Errorf("skipping to track %d: %w", track.Number, err)
+		}
+
+		pcm := io.LimitReader(d, int64(track.End-track.Start)*frameSize) //nolint:gosec // Sample counts are 36-bit.
+		if err := emit(track, pcm); err != nil {
+			return err
+		}
+
+		// Drain what emit left unread, so the next track starts in place.
+		if _, err := io.Copy(io.Discard, pcm); err != nil {
+			return err
+		}
+
+		if want := int64(track.End) * frameSize; d.pos != want { //nolint:gosec // Sample counts are 36-bit.
+			return fmt.Errorf("%w: track %d ends at sample %d, past the stream",
+				ErrReadFailure, track.Number, track.End)
+		}
+	}
+
+	return nil
+}
+
+// baseTags returns the stream's tags shared by every track, completed with the
+// album title and performer of cue.
+func baseTags(comment *VorbisComment, cue *CueFile) *VorbisComment {
+	base := &VorbisComment{}
+	if comment != nil {
+		base.Tags = slices.Clone(comment.Tags)
+	}
+
+	for _, name := range perTrackTags {
+		base.Delete(name)
+	}
+
+	if cue != nil {
+		if cue.Title != "" && base.Get("ALBUM") == nil {
+			base.Add("ALBUM", cue.Title)
+		}
+
+		if cue.Performer != "" && base.Get("ALBUMARTIST") == nil {
+			base.Add("ALBUMARTIST", cue.Performer)
+		}
+
+		if cue.Performer != "" && base.Get("ARTIST") == nil {
+			base.Add("ARTIST", cue.Performer)
+		}
+	}
+
+	return base
+}
+
+// trackTags returns the tags of track, one of total tracks.
+func trackTags(base *VorbisComment, track *SplitTrack, total int, sheet *CueSheet, cue *CueFile) []Tag {
+	tags := &VorbisComment{Tags: slices.Clone(base.Tags)}
+
+	if cue != nil {
+		if i := slices.IndexFunc(cue.Tracks, func(t CueFileTrack) bool { return t.Number == track.Number }); i >= 0 {
+			if title := cue.Tracks[i].Title; title != "" {
+				tags.Add("TITLE", title)
+			}
+
+			if performer := cue.Tracks[i].Performer; performer != "" {
+				tags.Set("ARTIST", performer)
+			}
+		}
+	}
+
+	tags.Add("TRACKNUMBER", strconv.Itoa(int(track.Number)))
+	tags.Add("TRACKTOTAL", strconv.Itoa(total))
+
+	i := slices.IndexFunc(sheet.Tracks, func(t CueTrack) bool { return t.Number == track.Number })
+	if isrc := strings.TrimSpace(sheet.Tracks[i].ISRC); isrc != "" {
+		tags.Add("ISRC", isrc)
+	}
+
+	return tags.Tags
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"math"
+
+	"github.com/mewkiz/flac/frame"
+)
+
+// stereoBuffers holds the mid and side signals derived from a stereo block.
+type stereoBuffers struct {
+	mid  []int32
+	side []int32
+}
+
+// decorrelate fills mid and side from left and right using the same arithmetic
+// as the decoder. It reports false when a side sample does not fit in 32 bits
+// (32-bit input only), in which case only independent coding is possible.
+//
+//nolint:varnamelen // i is the sample index.
+func (b *stereoBuffers) decorrelate(left, right []int32) bool {
+	size := len(left)
+	if cap(b.mid) < size {
+		b.mid = make([]int32, size)
+		b.side = make([]int32, size)
+	}
+
+	b.mid = b.mid[:size]
+	b.side = b.side[:size]
+
+	for i := range size {
+		l, r := int64(left[i]), int64(right[i])
+
+		side := l - r
+		if side < math.MinInt32 || side > math.MaxInt32 {
+			return false
+		}
+
+		b.mid[i] = int32((l + r) >> 1) //nolint:gosec // The mean of two int32 values fits int32.
+		b.side[i] = int32(side)
+	}
+
+	return true
+}
+
+// planStereo picks the cheapest channel assignment for a stereo block among
+// independent, left/side, side/right and mid/side coding. Side channels carry
+// one extra bit per sample. The returned plans are in subframe order.
+func (p *planner) planStereo(left, right []int32, bps uint, buffers *stereoBuffers) (frame.Channels, [2]subframePlan) {
+	leftPlan := p.plan(left, bps)
+	rightPlan := p.plan(right, bps)
+
+	best := frame.ChannelsLR
+	plans := [2]subframePlan{leftPlan, rightPlan}
+
+	if !buffers.decorrelate(left, right) {
+		return best, plans
+	}
+
+	midPlan := p.plan(buffers.mid, bps)
+	sidePlan := p.plan(buffers.side, bps+1)
+
+	bestBits := leftPlan.bits + rightPlan.bits
+
+	candidates := [...]struct {
+		channels frame.Channels
+		plans    [2]subframePlan
+	}{
+		{frame.ChannelsLeftSide, [2]subframePlan{leftPlan, sidePlan}},
+		{frame.ChannelsSideRight, [2]subframePlan{sidePlan, rightPlan}},
+		{frame.ChannelsMidSide, [2]subframePlan{midPlan, sidePlan}},
+	}
+
+	for _, candidate := range candidates {
+		if bits := candidate.plans[0].bits + candidate.plans[1].bits; bits < bestBits {
+			bestBits = bits
+			best = candidate.channels
+			plans = candidate.plans
+		}
+	}
+
+	return best, plans
+}
+
+// planAssignment plans a stereo block under a fixed channel assignment. It
+// reports false when the assignment needs a side channel that does not fit
+// in 32 bits.
+func (p *planner) planAssignment(
+	assignment frame.Channels, left, right []int32, bps uint, buffers *stereoBuffers,
+) ([2]subframePlan, bool) {
+	if assignment == frame.ChannelsLR {
+		return [2]subframePlan{p.plan(left, bps), p.plan(right, bps)}, true
+	}
+
+	if !buffers.decorrelate(left, right) {
+		return [2]subframePlan{}, false
+	}
+
+	switch assignment {
+	case frame.ChannelsLeftSide:
+		return [2]subframePlan{p.plan(left, bps), p.plan(buffers.side, bps+1)}, true
+	case frame.ChannelsSideRight:
+		return [2]subframePlan{p.plan(buffers.side, bps+1), p.plan(right, bps)}, true
+	default:
+		return [2]subframePlan{p.plan(buffers.mid, bps), p.plan(buffers.side, bps+1)}, true
+	}
+}
@@ -0,0 +1,177 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package flac
+
+import (
+	"math"
+
+	"github.com/mewkiz/flac/frame"
+)
+
+const maxFixedOrder = 4
+
+// subframePlan is the cheapest encoding found for one channel of a block. The
+// header is handed to goflac, which recomputes the residuals while writing.
+type subframePlan struct {
+	header frame.SubHeader
+	bits   uint64
+}
+
+// planner searches prediction methods for the subframes of one Encoder. It
+// owns the scratch state of the LPC search so blocks encode without
+// reallocating.
+type planner struct {
+	// Highest LPC order to consider; 0 restricts the search to fixed predictors.
+	maxLPCOrder int
+	// Quantized coefficient precision in bits; 0 picks one from bit depth and block size.
+	qlpPrecision int
+	// Try every coefficient precision instead of only the configured one.
+	precisionSearch bool
+	// Try every LPC order instead of the one estimated from the prediction error.
+	exhaustive bool
+	// Range of Rice partition orders to search.
+	minPartitionOrder int
+	maxPartitionOrder int
+
+	// Apodization windows, realized per block size into windowCache.
+	windows     []Window
+	windowCache [][]float64
+	windowSize  int
+
+	lpc      lpcAnalysis
+	rice     riceSearch
+	residual []int32
+}
+
+// plan picks the cheapest encoding for samples at the given bits per sample
+// (one more than the frame depth for side channels).
+func (p *planner) plan(samples []int32, bps uint) subframePlan {
+	// Digital silence and DC offsets store the value once, whatever the block size.
+	if isConstant(samples) {
+		return subframePlan{
+			header: frame.SubHeader{Pred: frame.PredConstant},
+			bits:   uint64(bps),
+		}
+	}
+
+	best := subframePlan{
+		header: frame.SubHeader{Pred: frame.PredVerbatim},
+		bits:   uint64(len(samples)) * uint64(bps),
+	}
+
+	if fixed, ok := p.planFixed(samples, bps); ok && fixed.bits < best.bits {
+		best = fixed
+	}
+
+	if lpc, ok := p.planLPC(samples, bps); ok && lpc.bits < best.bits {
+		best = lpc
+	}
+
+	return best
+}
+
+// isConstant reports whether every sample of the block holds the same value.
+func isConstant(samples []int32) bool {
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// planFixed evaluates the fixed predictors of order 0 to 4 and returns the cheapest.
+func (p *planner) planFixed(samples []int32, bps uint) (subframePlan, bool) {
+	var (
+		best  subframePlan
+		found bool
+	)
+
+	for order := 0; order <= maxFixedOrder && order < len(samples); order++ {
+		residuals, ok := fixedResiduals(p.residualBuffer(len(samples)), samples, order)
+		if !ok {
+			continue
+		}
+
+		method, rice, residualBits := p.planResidual(residuals, len(samples), order)
+		bits := uint64(order)*uint64(bps) + residualBits //nolint:gosec // order is 0-4.
+
+		if found && bits >= best.bits {
+			continue
+		}
+
+		best = subframePlan{
+			header: frame.SubHeader{
+				Pred:                 frame.PredFixed,
+				Order:                order,
+				ResidualCodingMethod: method,
+				RiceSubframe:         rice,
+			},
+			bits: bits,
+		}
+		found = true
+	}
+
+	return best, found
+}
+
+// residualBuffer returns scratch space for the residuals of a block of size samples.
+func (p *planner) residualBuffer(size int) []int32 {
+	if cap(p.residual) < size {
+		p.residual = make([]int32, size)
+	}
+
+	return p.residual[:0]
+}
+
+// fixedResiduals appends the residuals of the fixed predictor of the given
+// order to dst. It reports false when a residual does not fit in 32 bits,
+// which FLAC forbids (reachable with 32-bit and side channels).
+//
+//nolint:varnamelen // i is the sample index, as in the FLAC specification.
+func fixedResiduals(dst, samples []int32, order int) ([]int32, bool) {
+	for i := order; i < len(samples); i++ {
+		var pred int64
+
+		switch order {
+		case 0:
+		case 1:
+			pred = int64(samples[i-1])
+		case 2:
+			pred = 2*int64(samples[i-1]) - int64(samples[i-2])
+		case 3:
+			pred = 3*int64(samples[i-1]) - 3*int64(samples[i-2]) + int64(samples[i-3])
+		case 4:
+			pred = 4*int64(samples[i-1]) - 6*int64(samples[i-2]) + 4*int64(samples[i-3]) - int64(samples[i-4])
+		}
+
+		residual := int64(samples[i]) - pred
+		if residual < math.MinInt32 || residual > math.MaxInt32 {
+			return nil, false
+		}
+
+		dst = append(dst, int32(residual))
+	}
+
+	return dst, true
+}
+
+// zigzag folds a signed residual onto the unsigned range as Rice coding expects.
+func zigzag(residual int64) uint64 {
+	return uint64((residual << 1) ^ (residual >> 63)) //nolint:gosec // Intentional two's complement folding.
+}
@@ -204,6 +204,8 @@ func benchEncodeFlacBin(t *testing.T, bf benchFormat, flacBin, srcPath, dstPath
 		durations[iter] = time.Since(start)
 	}
 
+	logEncodedRatio(t, "flac", srcPath, dstPath)
+
 	return computeResult(bf.Name, "flac", "encode", durations, agar.FileSize(t, srcPath))
 }
 
@@ -235,9 +237,21 @@ func benchEncodeFFmpeg(t *testing.T, bf benchFormat, srcPath, dstPath string) be
 		durations[iter] = time.Since(start)
 	}
 
+	logEncodedRatio(t, "ffmpeg", srcPath, dstPath)
+
 	return computeResult(bf.Name, "ffmpeg", "encode", durations, agar.FileSize(t, srcPath))
 }
 
+// logEncodedRatio reports the size of an encoded file relative to its raw PCM source,
+// matching the line benchEncodeSaprobe logs.
+func logEncodedRatio(t *testing.T, tool, srcPath, dstPath string) {
+	t.Helper()
+
+	encSize := agar.FileSize(t, dstPath)
+	ratio := float64(encSize) / float64(agar.FileSize(t, srcPath)) * 100
+	t.Logf("  %s encode: %.1f%% ratio (%d bytes)", tool, ratio, encSize)
+}
+
 func benchDecodeSaprobe(t *testing.T, bf benchFormat, srcPath string) benchResult {
 	t.Helper()
 
@@ -200,8 +200,14 @@ func runSubsetTest(
 // uncommonSkips lists uncommon FLAC test files that saprobe cannot decode yet.
 //
 //nolint:gochecknoglobals
-var uncommonSkips = map[string]string{
-	"10 - file starting at frame header.flac": "headerless FLAC (no fLaC signature) not supported",
+var uncommonSkips = map[string]string{}
+
+// uncommonHeaderless lists uncommon FLAC test files without a stream header,
+// decoded with NewFrameDecoder.
+//
+//nolint:gochecknoglobals
+var uncommonHeaderless = map[string]bool{
+	"10 - file starting at frame header.flac": true,
 }
 
 func runUncommonTest(t *testing.T, path, flacBin string) {
@@ -228,7 +234,11 @@ func runUncommonTest(t *testing.T, path, flacBin string) {
 			}
 		}()
 
-		saprobePCM, _, saprobeErr = decodeSaprobe(path)
+		if uncommonHeaderless[filepath.Base(path)] {
+			saprobePCM, saprobeErr = decodeFrames(path)
+		} else {
+			saprobePCM, _, saprobeErr = decodeSaprobe(path)
+		}
 	}()
 
 	if didPanic {
@@ -0,0 +1,222 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// testCue is a two-track image whose second track has a pregap, in the
+// canonical layout CueFile.WriteTo produces.
+const testCue = `CATALOG 1234567890123
+PERFORMER "The Band"
+TITLE "The Album"
+FILE "image.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    PERFORMER "The Band"
+    ISRC USABC1234567
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second Song"
+    FLAGS PRE
+    INDEX 00 00:01:10
+    INDEX 01 00:02:00
+`
+
+// TestCueFile parses a .cue file, embeds it as a CUESHEET at encode time and
+// exports it back to the same text.
+func TestCueFile(t *testing.T) {
+	t.Parallel()
+
+	cue, err := flac.ParseCueFile(strings.NewReader("\ufeffREM GENRE Rock\r\n" + testCue + "    SONGWRITER \"x\"\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if cue.Catalog != "1234567890123" || cue.Title != "The Album" || cue.File != "image.flac" || len(cue.Tracks) != 2 {
+		t.Fatalf("cue: got %+v", cue)
+	}
+
+	wantTrack := flac.CueFileTrack{
+		Number: 2, IsAudio: true, Title: "Second Song", PreEmphasis: true,
+		Indices: []flac.CueFileIndex{{Number: 0, Frame: 85}, {Number: 1, Frame: 150}},
+	}
+	if !reflect.DeepEqual(cue.Tracks[1], wantTrack) {
+		t.Errorf("track 2: got %+v, want %+v", cue.Tracks[1], wantTrack)
+	}
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 3)
+	total := uint64(len(srcPCM) / 4)
+
+	sheet, err := cue.CueSheet(format.SampleRate, total)
+	if err != nil {
+		t.Fatalf("cue sheet: %v", err)
+	}
+
+	want := &flac.CueSheet{
+		MCN: "1234567890123", LeadIn: 88200, IsCD: true,
+		Tracks: []flac.CueTrack{
+			{Number: 1, ISRC: "USABC1234567", IsAudio: true, Indices: []flac.CueIndex{{Number: 1}}},
+			{
+				Offset: 85 * 588, Number: 2, IsAudio: true, PreEmphasis: true,
+				Indices: []flac.CueIndex{{Number: 0}, {Offset: 65 * 588, Number: 1}},
+			},
+			{Offset: total, Number: 170},
+		},
+	}
+	if !reflect.DeepEqual(sheet, want) {
+		t.Fatalf("cue sheet: got %+v, want %+v", sheet, want)
+	}
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.CueSheet = sheet
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	md, err := flac.ReadMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+
+	if !reflect.DeepEqual(md.CueSheet(), want) {
+		t.Fatalf("embedded cue sheet: got %+v, want %+v", md.CueSheet(), want)
+	}
+
+	// The sheet carries no titles; restore them to compare the text.
+	exported := md.CueSheet().CueFile(format.SampleRate, "image.flac")
+	exported.Performer, exported.Title = cue.Performer, cue.Title
+
+	for i := range exported.Tracks {
+		exported.Tracks[i].Title, exported.Tracks[i].Performer = cue.Tracks[i].Title, cue.Tracks[i].Performer
+	}
+
+	var text strings.Builder
+	if _, err := exported.WriteTo(&text); err != nil {
+		t.Fatalf("write cue: %v", err)
+	}
+
+	if text.String() != testCue {
+		t.Errorf("exported cue:\n%s\nwant:\n%s", text.String(), testCue)
+	}
+
+	// A stream that is not a whole number of CD sectors is not CD-DA.
+	sheet, err = cue.CueSheet(format.SampleRate, total+1)
+	if err != nil {
+		t.Fatalf("cue sheet: %v", err)
+	}
+
+	if sheet.IsCD || sheet.LeadIn != 0 || sheet.Tracks[2].Number != 255 {
+		t.Errorf("non CD-DA sheet: got %+v", sheet)
+	}
+}
+
+// TestCueFileInvalid rejects malformed .cue files and sheets.
+func TestCueFileInvalid(t *testing.T) {
+	t.Parallel()
+
+	const head = "FILE \"a.wav\" WAVE\n  TRACK 01 AUDIO\n"
+
+	for name, text := range map[string]string{
+		"no tracks":         "FILE \"a.wav\" WAVE\n",
+		"no index 01":       head + "    INDEX 00 00:00:00\n",
+		"track before file": "TRACK 01 AUDIO\n    INDEX 01 00:00:00\n",
+		"bad position":      head + "    INDEX 01 00:60:00\n",
+		"index order":       head + "    INDEX 01 00:00:00\n    INDEX 03 00:01:00\n",
+		"multiple files":    head + "    INDEX 01 00:00:00\nFILE \"b.wav\" WAVE\n",
+		"index outside":     "FILE \"a.wav\" WAVE\nINDEX 01 00:00:00\n",
+	} {
+		if _, err := flac.ParseCueFile(strings.NewReader(text)); !errors.Is(err, flac.ErrInvalidCue) {
+			t.Errorf("%s: got %v, want ErrInvalidCue", name, err)
+		}
+	}
+
+	cue, err := flac.ParseCueFile(strings.NewReader(testCue))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	// The lead-out must follow the last track.
+	if _, err := cue.CueSheet(44100, 100); !errors.Is(err, flac.ErrInvalidCue) {
+		t.Errorf("short stream: got %v, want ErrInvalidCue", err)
+	}
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.CueSheet = &flac.CueSheet{
+		IsCD:   true,
+		Tracks: []flac.CueTrack{{Number: 1, Indices: []flac.CueIndex{{Number: 1}}}},
+	}
+
+	var buf bytes.Buffer
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	if err := flac.Encode(&buf, make([]byte, 4096), format, opts); !errors.Is(err, flac.ErrInvalidOptions) {
+		t.Errorf("sheet without lead-out: got %v, want ErrInvalidOptions", err)
+	}
+}
+
+// TestCueFileWriteEscaping writes values a quoted string cannot hold, such as
+// tags with quotes or line breaks, as .cue text that reads back.
+func TestCueFileWriteEscaping(t *testing.T) {
+	t.Parallel()
+
+	cue := &flac.CueFile{
+		Performer: `The "Band"`,
+		Title:     "Two\r\nLines\nTRACK 99 AUDIO",
+		File:      `say "hi".wav`,
+		Tracks: []flac.CueFileTrack{{
+			Number: 1, IsAudio: true, Title: `"Quoted"`,
+			Indices: []flac.CueFileIndex{{Number: 1}},
+		}},
+	}
+
+	var text strings.Builder
+	if _, err := cue.WriteTo(&text); err != nil {
+		t.Fatalf("write cue: %v", err)
+	}
+
+	parsed, err := flac.ParseCueFile(strings.NewReader(text.String()))
+	if err != nil {
+		t.Fatalf("parse written cue: %v\n%s", err, text.String())
+	}
+
+	want := &flac.CueFile{
+		Performer: "The 'Band'",
+		Title:     "Two Lines TRACK 99 AUDIO",
+		File:      "say 'hi'.wav",
+		Tracks:    []flac.CueFileTrack{{Number: 1, IsAudio: true, Title: "'Quoted'", Indices: cue.Tracks[0].Indices}},
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Errorf("round trip: got %+v, want %+v", parsed, want)
+	}
+
+	cue.Tracks[0].ISRC = "USABC123\n4567"
+	if _, err := cue.WriteTo(io.Discard); !errors.Is(err, flac.ErrInvalidCue) {
+		t.Errorf("ISRC with a line break: got %v, want ErrInvalidCue", err)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/mycophonic/agar/pkg/agar"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// md5Offset is where the STREAMINFO MD5 starts: signature, block header, then 18 bytes of fields.
+const md5Offset = 4 + 4 + 18
+
+// TestDecoderVerifyMD5 checks that verification passes on intact streams, reports
+// ErrMD5Mismatch when the signature disagrees, and is skipped when no signature is stored.
+func TestDecoderVerifyMD5(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth24, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 24, 2, 1)
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	verify := flac.DecoderOptions{VerifyMD5: true}
+
+	pcm, _, err := flac.Decode(bytes.NewReader(buf.Bytes()), verify)
+	if err != nil {
+		t.Fatalf("verified decode: %v", err)
+	}
+
+	agar.CompareLosslessSamples(t, "verified", srcPCM, pcm, 24, 2)
+
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[md5Offset] ^= 0xFF
+
+	if _, _, err := flac.Decode(bytes.NewReader(corrupt), verify); !errors.Is(err, flac.ErrMD5Mismatch) {
+		t.Errorf("corrupt signature: got %v, want ErrMD5Mismatch", err)
+	}
+
+	// Without the option, the mismatch goes unnoticed.
+	if _, _, err := flac.Decode(bytes.NewReader(corrupt)); err != nil {
+		t.Errorf("unverified decode: %v", err)
+	}
+
+	unset := bytes.Clone(buf.Bytes())
+	clear(unset[md5Offset : md5Offset+16])
+
+	dec, err := flac.NewDecoder(bytes.NewReader(unset), verify)
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+
+	if dec.HasMD5() {
+		t.Error("HasMD5 reported a signature on a zeroed MD5")
+	}
+
+	if _, err := io.ReadAll(dec); err != nil {
+		t.Errorf("decode without signature: %v", err)
+	}
+}
+
+// TestStreamDecoder decodes through a pipe, which cannot seek, with MD5
+// verification, and checks that seeking is refused.
+func TestStreamDecoder(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 48000, BitDepth: flac.Depth24, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 24, 2, 2)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.Tags = []flac.Tag{{Name: "TITLE", Value: "Piped"}}
+	opts.Padding = 512
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		_, err := pipeWriter.Write(buf.Bytes())
+		pipeWriter.CloseWithError(err)
+	}()
+
+	dec, err := flac.NewStreamDecoder(pipeReader, flac.DecoderOptions{VerifyMD5: true})
+	if err != nil {
+		t.Fatalf("new stream decoder: %v", err)
+	}
+	defer dec.Close()
+
+	if dec.Format() != format || dec.Metadata().VorbisComment().Get("TITLE")[0] != "Piped" {
+		t.Errorf("format %+v, metadata %+v", dec.Format(), dec.Metadata())
+	}
+
+	// Refused seeks leave the decoder reading on from the start.
+	if err := dec.SeekSample(1000); !errors.Is(err, flac.ErrNotSeekable) {
+		t.Fatalf("seek: got %v, want ErrNotSeekable", err)
+	}
+
+	if _, err := dec.Seek(0, io.SeekStart); !errors.Is(err, flac.ErrNotSeekable) {
+		t.Fatalf("seek: got %v, want ErrNotSeekable", err)
+	}
+
+	pcm, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+}
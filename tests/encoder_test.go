@@ -0,0 +1,677 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	goflac "github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+	"github.com/mycophonic/agar/pkg/agar"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// TestStreamingEncoder feeds PCM through NewEncoder in awkward chunk sizes (splitting
+// samples and blocks) and verifies the stream round-trips and STREAMINFO is patched.
+func TestStreamingEncoder(t *testing.T) {
+	t.Parallel()
+
+	for _, bitDepth := range bitDepths {
+		t.Run(fmt.Sprintf("%dbit", bitDepth), func(t *testing.T) {
+			t.Parallel()
+
+			const (
+				sampleRate = 44100
+				channels   = 2
+			)
+
+			srcPCM := agar.GenerateWhiteNoise(sampleRate, bitDepth, channels, 1)
+			format := flac.PCMFormat{SampleRate: sampleRate, BitDepth: flac.BitDepth(bitDepth), Channels: channels}
+
+			path := filepath.Join(t.TempDir(), "stream.flac")
+
+			f, err := os.Create(path)
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			defer f.Close()
+
+			enc, err := flac.NewEncoder(f, format)
+			if err != nil {
+				t.Fatalf("new encoder: %v", err)
+			}
+
+			for chunk, rest := 0, srcPCM; len(rest) > 0; chunk++ {
+				n := min(len(rest), 1+chunk*7919%20000)
+				if _, err := enc.Write(rest[:n]); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+
+				rest = rest[n:]
+			}
+
+			if err := enc.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			pcm, _, err := decodeSaprobe(path)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			agar.CompareLosslessSamples(t, "streaming encoder", srcPCM, pcm, bitDepth, channels)
+
+			stream, err := goflac.ParseFile(path)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			defer stream.Close()
+
+			wantSamples := uint64(len(srcPCM) / (channels * agar.PCMBytesPerSample(bitDepth)))
+			if stream.Info.NSamples != wantSamples {
+				t.Errorf("NSamples: got %d, want %d", stream.Info.NSamples, wantSamples)
+			}
+
+			if stream.Info.FrameSizeMin == 0 || stream.Info.FrameSizeMax < stream.Info.FrameSizeMin {
+				t.Errorf("frame sizes not patched: min=%d max=%d", stream.Info.FrameSizeMin, stream.Info.FrameSizeMax)
+			}
+
+			if want := md5.Sum(srcPCM); stream.Info.MD5sum != want {
+				t.Errorf("MD5: got %x, want %x", stream.Info.MD5sum, want)
+			}
+		})
+	}
+}
+
+// TestStreamingEncoderNonSeekable checks that a plain io.Writer yields a valid stream
+// and that trailing partial samples are rejected on Close.
+func TestStreamingEncoderNonSeekable(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 48000, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := agar.GenerateWhiteNoise(format.SampleRate, 16, 2, 1)
+
+	var buf bytes.Buffer
+
+	enc, err := flac.NewEncoder(&buf, format)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+
+	if _, err := enc.Write(srcPCM); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	pcm, _, err := flac.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	agar.CompareLosslessSamples(t, "non-seekable", srcPCM, pcm, 16, 2)
+
+	// Streaming to a plain writer cannot patch the header: the MD5 stays "unset".
+	if info := parseStreamInfo(t, buf.Bytes()); info.MD5sum != [md5.Size]byte{} {
+		t.Errorf("MD5 of unpatched stream: got %x, want zero", info.MD5sum)
+	}
+
+	// Encode knows the whole input up front, so its header is complete without seeking.
+	buf.Reset()
+
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if info, want := parseStreamInfo(t, buf.Bytes()), md5.Sum(srcPCM); info.MD5sum != want {
+		t.Errorf("Encode MD5: got %x, want %x", info.MD5sum, want)
+	}
+
+	enc, err = flac.NewEncoder(&bytes.Buffer{}, format)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+
+	if _, err := enc.Write(srcPCM[:3]); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := enc.Close(); err == nil {
+		t.Error("expected error closing encoder with a partial sample")
+	}
+}
+
+// TestEncoderCompresses checks that predictable audio encodes well below its PCM size.
+func TestEncoderCompresses(t *testing.T) {
+	t.Parallel()
+
+	for _, bitDepth := range []int{16, 24} {
+		t.Run(fmt.Sprintf("%dbit", bitDepth), func(t *testing.T) {
+			t.Parallel()
+
+			srcPCM := generateTone(44100, bitDepth, 2, 2)
+			format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.BitDepth(bitDepth), Channels: 2}
+
+			var buf bytes.Buffer
+			if err := flac.Encode(&buf, srcPCM, format); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			ratio := float64(buf.Len()) / float64(len(srcPCM))
+			t.Logf("ratio: %.1f%%", ratio*100)
+
+			if ratio > 0.6 {
+				t.Errorf("poor compression: %.1f%% of PCM size", ratio*100)
+			}
+
+			pcm, _, err := flac.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			agar.CompareLosslessSamples(t, "tone", srcPCM, pcm, bitDepth, 2)
+		})
+	}
+}
+
+// TestEncoderConstantChannels checks that silent and DC-only channels cost a few bytes
+// per frame: a 7.1 stream with a single live channel must stay close to its mono size.
+func TestEncoderConstantChannels(t *testing.T) {
+	t.Parallel()
+
+	const (
+		sampleRate = 44100
+		channels   = 8
+		dcValue    = -1234
+	)
+
+	mono := generateTone(sampleRate, 16, 1, 2)
+	nSamples := len(mono) / 2
+
+	srcPCM := make([]byte, 0, len(mono)*channels)
+	for i := range nSamples {
+		srcPCM = append(srcPCM, mono[2*i], mono[2*i+1])
+		// Channel 1 carries a DC offset, the remaining six are digital silence.
+		srcPCM = append(srcPCM, byte(dcValue&0xFF), byte(dcValue>>8&0xFF))
+		srcPCM = append(srcPCM, make([]byte, 2*(channels-2))...)
+	}
+
+	var monoBuf, surroundBuf bytes.Buffer
+	monoFormat := flac.PCMFormat{SampleRate: sampleRate, BitDepth: flac.Depth16, Channels: 1}
+	if err := flac.Encode(&monoBuf, mono, monoFormat); err != nil {
+		t.Fatalf("encode mono: %v", err)
+	}
+
+	format := flac.PCMFormat{SampleRate: sampleRate, BitDepth: flac.Depth16, Channels: channels}
+	if err := flac.Encode(&surroundBuf, srcPCM, format); err != nil {
+		t.Fatalf("encode 7.1: %v", err)
+	}
+
+	// Each constant subframe is a 1-byte header plus the 16-bit value; allow double that.
+	const perFrameBudget = (channels - 1) * 6
+
+	nFrames := (nSamples + 4095) / 4096
+	if overhead := surroundBuf.Len() - monoBuf.Len(); overhead > nFrames*perFrameBudget {
+		t.Errorf("constant channels cost %d bytes over mono across %d frames, want at most %d",
+			overhead, nFrames, nFrames*perFrameBudget)
+	}
+
+	pcm, _, err := flac.Decode(bytes.NewReader(surroundBuf.Bytes()))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	agar.CompareLosslessSamples(t, "constant channels", srcPCM, pcm, 16, channels)
+}
+
+// TestEncoderStereoDecorrelation checks that correlated stereo costs little more than
+// mono, and that 32-bit blocks whose side channel would exceed 32 bits still round-trip.
+func TestEncoderStereoDecorrelation(t *testing.T) {
+	t.Parallel()
+
+	for _, bitDepth := range []int{16, 24, 32} {
+		t.Run(fmt.Sprintf("%dbit", bitDepth), func(t *testing.T) {
+			t.Parallel()
+
+			const sampleRate = 44100
+
+			bytesPerSample := agar.PCMBytesPerSample(bitDepth)
+			mono := generateTone(sampleRate, bitDepth, 1, 1)
+
+			// Right duplicates left, so side is silent and mid equals left.
+			srcPCM := make([]byte, 0, 2*len(mono))
+			for i := 0; i < len(mono); i += bytesPerSample {
+				srcPCM = append(srcPCM, mono[i:i+bytesPerSample]...)
+				srcPCM = append(srcPCM, mono[i:i+bytesPerSample]...)
+			}
+
+			if bitDepth == 32 {
+				// Full-scale opposite extremes in the first block: left-right needs 33 bits.
+				for i := 0; i < 64; i++ {
+					pos := i * 2 * bytesPerSample
+					binary.LittleEndian.PutUint32(srcPCM[pos:], math.MaxInt32)
+					binary.LittleEndian.PutUint32(srcPCM[pos+bytesPerSample:], 1<<31)
+				}
+			}
+
+			var monoBuf, stereoBuf bytes.Buffer
+
+			monoFormat := flac.PCMFormat{SampleRate: sampleRate, BitDepth: flac.BitDepth(bitDepth), Channels: 1}
+			if err := flac.Encode(&monoBuf, mono, monoFormat); err != nil {
+				t.Fatalf("encode mono: %v", err)
+			}
+
+			format := flac.PCMFormat{SampleRate: sampleRate, BitDepth: flac.BitDepth(bitDepth), Channels: 2}
+			if err := flac.Encode(&stereoBuf, srcPCM, format); err != nil {
+				t.Fatalf("encode stereo: %v", err)
+			}
+
+			t.Logf("mono %d bytes, stereo %d bytes", monoBuf.Len(), stereoBuf.Len())
+
+			if bitDepth != 32 && float64(stereoBuf.Len()) > 1.1*float64(monoBuf.Len()) {
+				t.Errorf("identical channels not decorrelated: stereo %d bytes, mono %d bytes",
+					stereoBuf.Len(), monoBuf.Len())
+			}
+
+			pcm, _, err := flac.Decode(bytes.NewReader(stereoBuf.Bytes()))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			agar.CompareLosslessSamples(t, "stereo", srcPCM, pcm, bitDepth, 2)
+		})
+	}
+}
+
+// TestEncoderNoise checks that incompressible input falls back to escaped partitions or
+// verbatim subframes rather than expanding beyond its PCM size.
+func TestEncoderNoise(t *testing.T) {
+	t.Parallel()
+
+	for _, bitDepth := range bitDepths {
+		t.Run(fmt.Sprintf("%dbit", bitDepth), func(t *testing.T) {
+			t.Parallel()
+
+			srcPCM := agar.GenerateWhiteNoise(44100, bitDepth, 2, 1)
+			format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.BitDepth(bitDepth), Channels: 2}
+
+			var buf bytes.Buffer
+			if err := flac.Encode(&buf, srcPCM, format); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			// Compare against the packed sample size, as PCM pads 12- and 20-bit samples.
+			nSamples := len(srcPCM) / agar.PCMBytesPerSample(bitDepth)
+			packed := nSamples * bitDepth / 8
+
+			if ratio := float64(buf.Len()) / float64(packed); ratio > 1.01 {
+				t.Errorf("noise expanded to %.1f%% of its packed size", ratio*100)
+			}
+
+			pcm, _, err := flac.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			agar.CompareLosslessSamples(t, "noise", srcPCM, pcm, bitDepth, 2)
+		})
+	}
+}
+
+// TestEncoderLevels round-trips every compression preset and checks that the
+// strongest level beats the fastest one.
+func TestEncoderLevels(t *testing.T) {
+	t.Parallel()
+
+	srcPCM := generateTone(44100, 16, 2, 2)
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	sizes := make([]int, flac.MaxLevel+1)
+
+	for level := range flac.MaxLevel + 1 {
+		var buf bytes.Buffer
+		if err := flac.Encode(&buf, srcPCM, format, flac.Level(level)); err != nil {
+			t.Fatalf("level %d: encode: %v", level, err)
+		}
+
+		pcm, _, err := flac.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("level %d: decode: %v", level, err)
+		}
+
+		agar.CompareLosslessSamples(t, fmt.Sprintf("level %d", level), srcPCM, pcm, 16, 2)
+
+		sizes[level] = buf.Len()
+		t.Logf("level %d: %.1f%% ratio (%d bytes)", level, float64(buf.Len())/float64(len(srcPCM))*100, buf.Len())
+	}
+
+	if sizes[flac.MaxLevel] >= sizes[0] {
+		t.Errorf("level %d (%d bytes) not smaller than level 0 (%d bytes)",
+			flac.MaxLevel, sizes[flac.MaxLevel], sizes[0])
+	}
+}
+
+// TestEncoderOptions round-trips non-preset option combinations at the edges of
+// their ranges and checks that out-of-range values are rejected.
+func TestEncoderOptions(t *testing.T) {
+	t.Parallel()
+
+	custom := map[string]flac.EncoderOptions{
+		"zero value": {},
+		"tiny blocks": {
+			BlockSize: flac.MinBlockSize, MaxLPCOrder: 8, MaxPartitionOrder: flac.MaxPartitionOrder,
+			StereoMode: flac.StereoAdaptive,
+		},
+		"exhaustive": {
+			BlockSize: 1024, MaxLPCOrder: flac.MaxLPCOrder, Exhaustive: true,
+			MinPartitionOrder: 2, MaxPartitionOrder: 8, StereoMode: flac.StereoMidSide,
+			Apodization: []flac.Window{flac.Rectangle(), flac.Hann()},
+		},
+		"precision search": {
+			MaxLPCOrder: 8, PrecisionSearch: true, MaxPartitionOrder: 6, StereoMode: flac.StereoMidSide,
+			Apodization: []flac.Window{flac.PartialTukey(3), flac.PunchoutTukey(3)},
+		},
+		"fixed precision": {BlockSize: 8192, MaxLPCOrder: 16, QLPPrecision: 15, StereoMode: flac.StereoMidSide},
+	}
+
+	for name, opts := range custom {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			for _, bitDepth := range []int{16, 24} {
+				srcPCM := generateTone(44100, bitDepth, 2, 1)
+				format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.BitDepth(bitDepth), Channels: 2}
+
+				var buf bytes.Buffer
+				if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+					t.Fatalf("%dbit: encode: %v", bitDepth, err)
+				}
+
+				pcm, _, err := flac.Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("%dbit: decode: %v", bitDepth, err)
+				}
+
+				agar.CompareLosslessSamples(t, name, srcPCM, pcm, bitDepth, 2)
+			}
+		})
+	}
+
+	invalid := map[string]flac.EncoderOptions{
+		"block size":      {BlockSize: 8},
+		"lpc order":       {MaxLPCOrder: flac.MaxLPCOrder + 1},
+		"precision":       {QLPPrecision: 16},
+		"partition order": {MinPartitionOrder: 4, MaxPartitionOrder: 2},
+		"stereo mode":     {StereoMode: flac.StereoMode(42)},
+		"tukey ratio":     {Apodization: []flac.Window{flac.Tukey(2)}},
+		"padding":         {Padding: -1},
+		"tag name":        {Tags: []flac.Tag{{Name: "A=B", Value: "x"}}},
+		"nil picture":     {Pictures: []*flac.Picture{nil}},
+	}
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+
+	for name, opts := range invalid {
+		if _, err := flac.NewEncoder(&bytes.Buffer{}, format, opts); !errors.Is(err, flac.ErrInvalidOptions) {
+			t.Errorf("%s: got %v, want ErrInvalidOptions", name, err)
+		}
+	}
+}
+
+// TestEncoderMetadata checks that tags, pictures and padding requested in the
+// options are written in one pass, by both Encode and a streaming Encoder
+// whose STREAMINFO is patched behind them.
+func TestEncoderMetadata(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 1)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.Tags = []flac.Tag{{Name: "ARTIST", Value: "Artist"}, {Name: "TITLE", Value: "Title"}}
+	opts.Pictures = []*flac.Picture{
+		{PictureType: flac.PictureFrontCover, MIME: "image/png", Data: []byte("front")},
+		{PictureType: flac.PictureBackCover, MIME: "image/png", Data: []byte("back")},
+	}
+	opts.Padding = 4096
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tagged.flac")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	enc, err := flac.NewEncoder(f, format, opts)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+
+	if _, err := enc.Write(srcPCM); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	_ = f.Close()
+
+	streamed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	for name, data := range map[string][]byte{"encode": buf.Bytes(), "stream": streamed} {
+		md, err := flac.ReadMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: read metadata: %v", name, err)
+		}
+
+		if len(md.Blocks) != 4 {
+			t.Fatalf("%s: got %d blocks, want 4", name, len(md.Blocks))
+		}
+
+		comment := md.VorbisComment()
+		if comment == nil || comment.Vendor == "" || !reflect.DeepEqual(comment.Tags, opts.Tags) {
+			t.Errorf("%s: vorbis comment: got %+v", name, comment)
+		}
+
+		if pictures := md.Pictures(); !reflect.DeepEqual(pictures, opts.Pictures) {
+			t.Errorf("%s: pictures: got %+v", name, pictures)
+		}
+
+		if padding, _ := md.Blocks[3].(*flac.Padding); padding == nil || padding.Length != opts.Padding {
+			t.Errorf("%s: padding: got %+v", name, md.Blocks[3])
+		}
+
+		pcm, _, err := flac.Decode(bytes.NewReader(data), flac.DecoderOptions{VerifyMD5: true})
+		if err != nil {
+			t.Fatalf("%s: decode: %v", name, err)
+		}
+
+		agar.CompareLosslessSamples(t, name, srcPCM, pcm, 16, 2)
+	}
+}
+
+// TestEncoderSeekTable checks that requested seek points resolve to frame
+// starts: through staging for Encode on a buffer, in place for a streaming
+// Encoder on a file, and as placeholders when streaming to a pipe.
+func TestEncoderSeekTable(t *testing.T) {
+	t.Parallel()
+
+	const blockSize, frameSize = 4096, 4
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 10)
+	total := uint64(len(srcPCM) / frameSize)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.SeekTable = flac.SeekTableOptions{Interval: time.Second, Points: []uint64{12345}, TotalSamples: total}
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seek.flac")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	var piped bytes.Buffer
+
+	for _, w := range []io.Writer{f, &piped} {
+		enc, err := flac.NewEncoder(w, format, opts)
+		if err != nil {
+			t.Fatalf("new encoder: %v", err)
+		}
+
+		if _, err := enc.Write(srcPCM); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		if err := enc.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+
+	_ = f.Close()
+
+	streamed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// Ten one-second points plus sample 12345, each in a different frame.
+	const wantPoints = 11
+
+	for name, data := range map[string][]byte{"encode": buf.Bytes(), "stream": streamed} {
+		md, err := flac.ReadMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: read metadata: %v", name, err)
+		}
+
+		table := md.SeekTable()
+		if table == nil || len(table.Points) != wantPoints {
+			t.Fatalf("%s: seek table: got %+v", name, table)
+		}
+
+		// Signature, STREAMINFO and the SEEKTABLE come before the first frame.
+		audioStart := uint64(4 + 4 + 34 + 4 + 18*wantPoints)
+
+		for _, point := range table.Points {
+			frame := data[audioStart+point.Offset:]
+			if point.Sample%blockSize != 0 || point.Samples != blockSize ||
+				frame[0] != 0xFF || frame[1] != 0xF8 || uint64(frame[4]) != point.Sample/blockSize {
+				t.Errorf("%s: point %+v does not address its frame", name, point)
+			}
+		}
+
+		if table.Points[1].Sample != 12288 {
+			t.Errorf("%s: sample 12345 resolved to %d, want 12288", name, table.Points[1].Sample)
+		}
+
+		dec, err := flac.NewDecoder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: new decoder: %v", name, err)
+		}
+
+		checkSeeks(t, dec, srcPCM, seekTargets(total, blockSize), frameSize)
+
+		_ = dec.Close()
+	}
+
+	md, err := flac.ReadMetadata(bytes.NewReader(piped.Bytes()))
+	if err != nil {
+		t.Fatalf("piped: read metadata: %v", err)
+	}
+
+	for _, point := range md.SeekTable().Points {
+		if point.Sample != flac.PlaceholderSample {
+			t.Errorf("piped: got point %+v, want placeholders only", point)
+		}
+	}
+
+	// Streaming needs the length to size an interval-based table.
+	opts.SeekTable.TotalSamples = 0
+	if _, err := flac.NewEncoder(&bytes.Buffer{}, format, opts); !errors.Is(err, flac.ErrInvalidOptions) {
+		t.Errorf("interval without total: got %v, want ErrInvalidOptions", err)
+	}
+
+	// An interval under one sample period puts a point in every frame.
+	opts.SeekTable = flac.SeekTableOptions{Interval: time.Nanosecond}
+
+	var short bytes.Buffer
+	if err := flac.Encode(&short, srcPCM[:3*blockSize*frameSize], format, opts); err != nil {
+		t.Fatalf("short interval: encode: %v", err)
+	}
+
+	md, err = flac.ReadMetadata(bytes.NewReader(short.Bytes()))
+	if err != nil {
+		t.Fatalf("short interval: read metadata: %v", err)
+	}
+
+	table := md.SeekTable()
+	if table == nil {
+		t.Fatal("short interval: no seek table")
+	}
+
+	var resolved []uint64
+
+	for _, point := range table.Points {
+		if point.Sample != flac.PlaceholderSample {
+			resolved = append(resolved, point.Sample)
+		}
+	}
+
+	if want := []uint64{0, blockSize, 2 * blockSize}; !reflect.DeepEqual(resolved, want) {
+		t.Errorf("short interval: points at %v, want %v", resolved, want)
+	}
+}
+
+// parseStreamInfo returns the STREAMINFO of an in-memory FLAC stream.
+func parseStreamInfo(t *testing.T, data []byte) *meta.StreamInfo {
+	t.Helper()
+
+	stream, err := goflac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	return stream.Info
+}
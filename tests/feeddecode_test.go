@@ -0,0 +1,245 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// TestFeedDecoder pushes a stream in chunks of random sizes, one byte
+// included, decoding every frame as soon as it is complete.
+func TestFeedDecoder(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 2)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.Tags = []flac.Tag{{Name: "TITLE", Value: "Fed"}}
+	opts.Padding = 512
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2)) //nolint:gosec // Deterministic chunking.
+	dec := flac.NewFeedDecoder(flac.DecoderOptions{VerifyMD5: true})
+
+	var pcm []byte
+
+	drain := func() error {
+		for {
+			frame, err := dec.NextFrame()
+			if err != nil {
+				return err
+			}
+
+			if want := uint64(len(pcm) / 4); frame.Sample != want {
+				t.Fatalf("frame at sample %d, want %d", frame.Sample, want)
+			}
+
+			pcm = append(pcm, frame.PCM...)
+		}
+	}
+
+	for data := buf.Bytes(); len(data) > 0; {
+		n := min(len(data), 1+rng.IntN(3000))
+		if rng.IntN(4) == 0 {
+			n = 1
+		}
+
+		if _, err := dec.Write(data[:n]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		data = data[n:]
+
+		if err := drain(); !errors.Is(err, flac.ErrNeedMoreData) {
+			t.Fatalf("next frame: got %v, want ErrNeedMoreData", err)
+		}
+	}
+
+	if dec.Format() != format || dec.Metadata().VorbisComment().Get("TITLE")[0] != "Fed" {
+		t.Errorf("format %+v, metadata %+v", dec.Format(), dec.Metadata())
+	}
+
+	_ = dec.Close()
+
+	if err := drain(); !errors.Is(err, io.EOF) {
+		t.Fatalf("next frame: got %v, want io.EOF", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+
+	if _, err := dec.Write([]byte{0}); err == nil {
+		t.Error("write after close succeeded")
+	}
+
+	// Input that ends within the metadata, or is not FLAC, fails once closed.
+	for name, data := range map[string][]byte{"truncated": buf.Bytes()[:100], "not flac": []byte("RIFF....WAVE")} {
+		dec := flac.NewFeedDecoder()
+		_, _ = dec.Write(data)
+		_ = dec.Close()
+
+		if _, err := dec.NextFrame(); !errors.Is(err, flac.ErrReadFailure) {
+			t.Errorf("%s: got %v, want ErrReadFailure", name, err)
+		}
+	}
+}
+
+// TestFeedDecoderFalseSync decodes a frame whose payload holds a copy of the
+// next frame's header, then trailing bytes after the last frame.
+func TestFeedDecoderFalseSync(t *testing.T) {
+	t.Parallel()
+
+	const blockSize = 4096
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+
+	// Noise is coded verbatim, so samples land byte-aligned in the frame.
+	rng := rand.New(rand.NewPCG(3, 4)) //nolint:gosec // Deterministic noise.
+	srcPCM := make([]byte, 3*blockSize*4)
+
+	for i := range srcPCM {
+		srcPCM[i] = byte(rng.Uint32())
+	}
+
+	// Header of frame 2: sync, 4096 samples, 44.1 kHz, independent stereo,
+	// 16 bits, frame number 2, CRC-8.
+	header := []byte{0xFF, 0xF8, 0xC9, 0x18, 0x02, 0}
+	for _, b := range header[:5] {
+		header[5] ^= b
+		for range 8 {
+			header[5] = header[5]<<1 ^ (header[5]>>7)*0x07
+		}
+	}
+
+	// Left samples 10 to 12 of frame 1 spell the header, big-endian.
+	for i := range 3 {
+		pos := (blockSize + 10 + i) * 4
+		srcPCM[pos], srcPCM[pos+1] = header[2*i+1], header[2*i]
+	}
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.BlockSize = blockSize
+	opts.StereoMode = flac.StereoIndependent
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if n := bytes.Count(buf.Bytes(), header); n != 2 {
+		t.Fatalf("frame 2 header found %d times, want 2", n)
+	}
+
+	// An ID3v1 tag follows the last frame.
+	tag := append([]byte("TAG"), make([]byte, 125)...)
+
+	dec := flac.NewFeedDecoder(flac.DecoderOptions{VerifyMD5: true})
+	_, _ = dec.Write(buf.Bytes())
+	_, _ = dec.Write(tag)
+	_ = dec.Close()
+
+	var pcm []byte
+
+	for {
+		frame, err := dec.NextFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("next frame after %d bytes: %v", len(pcm), err)
+		}
+
+		pcm = append(pcm, frame.PCM...)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+}
+
+// TestFeedDecoderLargeWrite writes a multi-megabyte stream in one call and
+// drains it frame by frame, then writes the rest once most of the buffer has
+// been read.
+func TestFeedDecoderLargeWrite(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+
+	rng := rand.New(rand.NewPCG(5, 6)) //nolint:gosec // Deterministic noise.
+	srcPCM := make([]byte, 25*format.SampleRate*4)
+
+	for i := range srcPCM {
+		srcPCM[i] = byte(rng.Uint32())
+	}
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, flac.Level(0)); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if buf.Len() < 4<<20 {
+		t.Fatalf("stream of %d bytes, want several megabytes", buf.Len())
+	}
+
+	dec := flac.NewFeedDecoder(flac.DecoderOptions{VerifyMD5: true})
+
+	var pcm []byte
+
+	drain := func() error {
+		for {
+			frame, err := dec.NextFrame()
+			if err != nil {
+				return err
+			}
+
+			pcm = append(pcm, frame.PCM...)
+		}
+	}
+
+	split := buf.Len() - 100_000
+
+	for _, chunk := range [][]byte{buf.Bytes()[:split], buf.Bytes()[split:]} {
+		_, _ = dec.Write(chunk)
+
+		if err := drain(); !errors.Is(err, flac.ErrNeedMoreData) {
+			t.Fatalf("next frame: got %v, want ErrNeedMoreData", err)
+		}
+	}
+
+	_ = dec.Close()
+
+	if err := drain(); !errors.Is(err, io.EOF) {
+		t.Fatalf("next frame: got %v, want io.EOF", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// TestFrameDecoder decodes frames stripped of their stream header, behind
+// junk bytes and from the middle of a stream.
+func TestFrameDecoder(t *testing.T) {
+	t.Parallel()
+
+	// Signature, then STREAMINFO as the only block.
+	const headerSize = 4 + 4 + 34
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth24, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 24, 2, 1)
+	frameSize := 2 * format.BitDepth.BytesPerSample()
+
+	opts := flac.Level(flac.DefaultLevel)
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	frames := buf.Bytes()[headerSize:]
+	junk := []byte{0xFF, 0xF8, 0x00, 0xFF, 'j', 'u', 'n', 'k', 0xFF}
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		params flac.StreamInfoParams
+		want   []byte
+	}{
+		{"headerless", frames, flac.StreamInfoParams{}, srcPCM},
+		{"params", frames, flac.StreamInfoParams{SampleRate: 44100, Channels: 2, BitDepth: flac.Depth24}, srcPCM},
+		{"junk", append(append([]byte{}, junk...), frames...), flac.StreamInfoParams{}, srcPCM},
+		// A capture starting inside the first frame syncs on the second one.
+		{"mid-frame", frames[1:], flac.StreamInfoParams{}, srcPCM[opts.BlockSize*frameSize:]},
+	} {
+		dec, err := flac.NewFrameDecoder(bytes.NewReader(tc.data), tc.params)
+		if err != nil {
+			t.Fatalf("%s: new frame decoder: %v", tc.name, err)
+		}
+
+		if got := dec.Format(); got != format {
+			t.Errorf("%s: format %+v, want %+v", tc.name, got, format)
+		}
+
+		pcm, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", tc.name, err)
+		}
+
+		if !bytes.Equal(pcm, tc.want) {
+			t.Errorf("%s: decoded %d bytes differing from the %d expected", tc.name, len(pcm), len(tc.want))
+		}
+
+		if err := dec.SeekSample(0); !errors.Is(err, flac.ErrNotSeekable) {
+			t.Errorf("%s: seek: got %v, want ErrNotSeekable", tc.name, err)
+		}
+
+		_ = dec.Close()
+	}
+
+	// Frames that disagree with the parameters never sync.
+	_, err := flac.NewFrameDecoder(bytes.NewReader(frames), flac.StreamInfoParams{Channels: 1})
+	if !errors.Is(err, flac.ErrNoFrameHeader) {
+		t.Errorf("mono params: got %v, want ErrNoFrameHeader", err)
+	}
+
+	_, err = flac.NewFrameDecoder(bytes.NewReader(frames), flac.StreamInfoParams{BitDepth: 13})
+	if !errors.Is(err, flac.ErrStreamParams) {
+		t.Errorf("bit depth 13: got %v, want ErrStreamParams", err)
+	}
+}
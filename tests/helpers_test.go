@@ -19,6 +19,9 @@ package tests_test
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -42,6 +45,23 @@ func decodeSaprobe(path string) ([]byte, flac.PCMFormat, error) {
 	return flac.Decode(f)
 }
 
+// decodeFrames decodes a headerless FLAC file using saprobe's frame decoder,
+// taking the stream parameters from the first frame header.
+func decodeFrames(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := flac.NewFrameDecoder(f, flac.StreamInfoParams{})
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	return io.ReadAll(dec)
+}
+
 // encodeSaprobe encodes raw PCM to FLAC using saprobe's encoder.
 func encodeSaprobe(srcPCM []byte, dstPath string, bitDepth, sampleRate, channels int) error {
 	format := flac.PCMFormat{
@@ -59,6 +79,33 @@ func encodeSaprobe(srcPCM []byte, dstPath string, bitDepth, sampleRate, channels
 	return flac.Encode(f, srcPCM, format)
 }
 
+// generateTone returns interleaved little-endian signed PCM holding a few
+// detuned partials per channel plus a little noise: compressible like music,
+// unlike agar.GenerateWhiteNoise.
+func generateTone(sampleRate, bitDepth, channels, durationSec int) []byte {
+	bytesPerSample := agar.PCMBytesPerSample(bitDepth)
+	nSamples := sampleRate * durationSec
+	amplitude := float64(int64(1)<<(bitDepth-1)-1) * 0.4
+	rng := rand.New(rand.NewPCG(uint64(sampleRate), uint64(bitDepth)))
+	pcm := make([]byte, 0, nSamples*channels*bytesPerSample)
+
+	for i := range nSamples {
+		phase := 2 * math.Pi * float64(i) / float64(sampleRate)
+
+		for ch := range channels {
+			detune := 1 + float64(ch)*0.01
+			v := 0.6*math.Sin(phase*220*detune) + 0.3*math.Sin(phase*660*detune) + 0.1*math.Sin(phase*1760*detune)
+			sample := int64(v*amplitude) + rng.Int64N(9) - 4
+
+			for b := range bytesPerSample {
+				pcm = append(pcm, byte(sample>>(8*b)))
+			}
+		}
+	}
+
+	return pcm
+}
+
 // flacBinaryEncode encodes raw PCM to FLAC using the standalone flac binary.
 func flacBinaryEncode(flacBin, srcPath, dstPath string, bitDepth, sampleRate, channels int) error {
 	cmd := exec.Command(flacBin,
@@ -104,6 +151,17 @@ func flacBinaryDecodeRaw(flacBin, srcPath string) ([]byte, error) {
 	return stdout.Bytes(), nil
 }
 
+// flacBinaryTest runs the reference decoder's integrity check (flac -t) on a file,
+// which validates every frame CRC, the residual coding and the STREAMINFO MD5.
+func flacBinaryTest(flacBin, path string) error {
+	output, err := exec.Command(flacBin, "-t", "-s", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("flac test: %w\n%s", err, output)
+	}
+
+	return nil
+}
+
 // discoverFiles returns all .flac files in the given directory, sorted by name.
 func discoverFiles(t *testing.T, dir string) []string {
 	t.Helper()
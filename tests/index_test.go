@@ -0,0 +1,112 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// TestFrameIndex builds indexes for fixed and variable block-size streams,
+// round-trips them through their binary encoding and seeks with them.
+func TestFrameIndex(t *testing.T) {
+	t.Parallel()
+
+	const sampleRate, frameSize = 44100, 4
+
+	srcPCM := generateTone(sampleRate, 16, 2, 3)
+	total := uint64(len(srcPCM) / frameSize)
+	format := flac.PCMFormat{SampleRate: sampleRate, BitDepth: flac.Depth16, Channels: 2}
+
+	variableFrames := 0
+	for sample := uint64(0); sample < total; variableFrames++ {
+		sample += uint64(variableBlockSizes[variableFrames%len(variableBlockSizes)])
+	}
+
+	var fixed bytes.Buffer
+	if err := flac.Encode(&fixed, srcPCM, format, flac.Level(0)); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	streams := []struct {
+		name   string
+		data   []byte
+		frames int
+	}{
+		{"fixed", fixed.Bytes(), int((total + 1151) / 1152)},
+		{"variable", encodeVariable(t, srcPCM, sampleRate, false), variableFrames},
+	}
+
+	for _, stream := range streams {
+		index, err := flac.BuildIndex(bytes.NewReader(stream.data))
+		if err != nil {
+			t.Fatalf("%s: build index: %v", stream.name, err)
+		}
+
+		if index.Len() != stream.frames {
+			t.Errorf("%s: indexed %d frames, want %d", stream.name, index.Len(), stream.frames)
+		}
+
+		if index.TotalSamples() != total {
+			t.Errorf("%s: index covers %d samples, want %d", stream.name, index.TotalSamples(), total)
+		}
+
+		data, err := index.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", stream.name, err)
+		}
+
+		var loaded flac.FrameIndex
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: unmarshal: %v", stream.name, err)
+		}
+
+		dec, err := flac.NewDecoder(bytes.NewReader(stream.data), flac.DecoderOptions{Index: &loaded})
+		if err != nil {
+			t.Fatalf("%s: new decoder: %v", stream.name, err)
+		}
+
+		checkSeeks(t, dec, srcPCM, seekTargets(total, 1152), frameSize)
+
+		_ = dec.Close()
+
+		if err := loaded.UnmarshalBinary(data[:len(data)-1]); !errors.Is(err, flac.ErrInvalidIndex) {
+			t.Errorf("%s: truncated index: got %v, want ErrInvalidIndex", stream.name, err)
+		}
+	}
+
+	// An index built from another stream is rejected.
+	other := generateTone(sampleRate, 16, 2, 1)
+
+	var short bytes.Buffer
+	if err := flac.Encode(&short, other, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	index, err := flac.BuildIndex(bytes.NewReader(short.Bytes()))
+	if err != nil {
+		t.Fatalf("build index: %v", err)
+	}
+
+	_, err = flac.NewDecoder(bytes.NewReader(fixed.Bytes()), flac.DecoderOptions{Index: index})
+	if !errors.Is(err, flac.ErrIndexMismatch) {
+		t.Errorf("foreign index: got %v, want ErrIndexMismatch", err)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mewkiz/flac/meta"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// TestDecoderMetadata checks that every standard block type surfaces, typed
+// and in stream order, from Decoder.Metadata.
+func TestDecoderMetadata(t *testing.T) {
+	t.Parallel()
+
+	const sampleRate = 44100
+
+	cover := []byte("\x89PNG fake image data")
+	srcPCM := generateTone(sampleRate, 16, 2, 1)
+
+	data := encodeVariable(t, srcPCM, sampleRate, true,
+		&meta.Block{
+			Header: meta.Header{Type: meta.TypeVorbisComment, Length: 1},
+			Body: &meta.VorbisComment{
+				Vendor: "test vendor",
+				Tags:   [][2]string{{"ARTIST", "First"}, {"TITLE", "Song"}, {"artist", "Second"}},
+			},
+		},
+		&meta.Block{
+			Header: meta.Header{Type: meta.TypePicture, Length: 1},
+			Body: &meta.Picture{
+				Type: 3, MIME: "image/png", Desc: "front", Width: 600, Height: 600, Depth: 24, Data: cover,
+			},
+		},
+		&meta.Block{
+			Header: meta.Header{Type: meta.TypeApplication, Length: 1},
+			Body:   &meta.Application{ID: 0x74657374, Data: []byte{1, 2, 3}},
+		},
+		&meta.Block{
+			Header: meta.Header{Type: meta.TypeCueSheet, Length: 1},
+			Body: &meta.CueSheet{
+				MCN: "1234567890123",
+				Tracks: []meta.CueSheetTrack{
+					{
+						Offset: 0, Num: 1, ISRC: "USABC1234567", IsAudio: true,
+						Indicies: []meta.CueSheetTrackIndex{{Num: 1}},
+					},
+					{Offset: 22050, Num: 255},
+				},
+			},
+		},
+		&meta.Block{Header: meta.Header{Type: meta.TypePadding, Length: 1024}},
+	)
+
+	dec, err := flac.NewDecoder(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+
+	md := dec.Metadata()
+
+	info := md.StreamInfo
+	if info.SampleRate != sampleRate || info.Channels != 2 || info.BitsPerSample != 16 ||
+		info.TotalSamples != uint64(len(srcPCM)/4) || info.BlockSizeMin != 16 || info.BlockSizeMax != 4608 {
+		t.Errorf("stream info: got %+v", info)
+	}
+
+	wantTypes := []flac.BlockType{
+		flac.BlockVorbisComment, flac.BlockPicture, flac.BlockApplication,
+		flac.BlockCueSheet, flac.BlockPadding, flac.BlockSeekTable,
+	}
+
+	gotTypes := make([]flac.BlockType, len(md.Blocks))
+	for i, block := range md.Blocks {
+		gotTypes[i] = block.Type()
+	}
+
+	if !reflect.DeepEqual(gotTypes, wantTypes) {
+		t.Fatalf("block types: got %v, want %v", gotTypes, wantTypes)
+	}
+
+	comment := md.VorbisComment()
+	if comment.Vendor != "test vendor" || len(comment.Tags) != 3 {
+		t.Errorf("vorbis comment: got %+v", comment)
+	}
+
+	if got := comment.Get("Artist"); !reflect.DeepEqual(got, []string{"First", "Second"}) {
+		t.Errorf("artists: got %q", got)
+	}
+
+	pictures := md.Pictures()
+	if len(pictures) != 1 {
+		t.Fatalf("got %d pictures, want 1", len(pictures))
+	}
+
+	want := &flac.Picture{
+		PictureType: flac.PictureFrontCover, MIME: "image/png", Description: "front",
+		Width: 600, Height: 600, Depth: 24, Data: cover,
+	}
+	if !reflect.DeepEqual(pictures[0], want) {
+		t.Errorf("picture: got %+v", pictures[0])
+	}
+
+	app, _ := md.Blocks[2].(*flac.Application)
+	if app == nil || string(app.ID[:]) != "test" || !bytes.Equal(app.Data, []byte{1, 2, 3}) {
+		t.Errorf("application: got %+v", md.Blocks[2])
+	}
+
+	cue := md.CueSheet()
+	if cue.MCN != "1234567890123" || len(cue.Tracks) != 2 || cue.Tracks[0].ISRC != "USABC1234567" ||
+		!cue.Tracks[0].IsAudio || cue.Tracks[1].Offset != 22050 || len(cue.Tracks[0].Indices) != 1 {
+		t.Errorf("cue sheet: got %+v", cue)
+	}
+
+	if padding, _ := md.Blocks[4].(*flac.Padding); padding == nil || padding.Length != 1024 {
+		t.Errorf("padding: got %+v", md.Blocks[4])
+	}
+
+	if table := md.SeekTable(); table == nil || len(table.Points) == 0 || table.Points[1].Sample == 0 {
+		t.Errorf("seek table: got %+v", table)
+	}
+
+	// The audio still decodes after the metadata.
+	pcm, _, err := flac.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+}
@@ -0,0 +1,374 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mewkiz/flac/meta"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// TestUpdateMetadata edits tags and pictures, growing the metadata past its
+// padding (a rewrite) and shrinking it back within the padding (in place), and
+// checks that the audio frames survive byte for byte.
+func TestUpdateMetadata(t *testing.T) {
+	t.Parallel()
+
+	// Signature, then STREAMINFO as the only block.
+	const headerSize = 4 + 4 + 34
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 1)
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	audio := buf.Bytes()[headerSize:]
+	path := filepath.Join(t.TempDir(), "edit.flac")
+
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// update applies edit, writes the result and checks the file against it.
+	update := func(edit func(md *flac.Metadata)) int64 {
+		t.Helper()
+
+		md := readMetadata(t, path)
+		edit(md)
+
+		if err := flac.UpdateMetadata(path, md); err != nil {
+			t.Fatalf("update metadata: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read back: %v", err)
+		}
+
+		if !bytes.HasSuffix(data, audio) {
+			t.Fatal("audio frames changed")
+		}
+
+		pcm, _, err := flac.Decode(bytes.NewReader(data), flac.DecoderOptions{VerifyMD5: true})
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+
+		if !bytes.Equal(pcm, srcPCM) {
+			t.Fatal("decoded audio differs from source")
+		}
+
+		got := readMetadata(t, path)
+		if !reflect.DeepEqual(withoutPadding(got), withoutPadding(md)) {
+			t.Fatalf("metadata: got %+v, want %+v", got, md)
+		}
+
+		return int64(len(data))
+	}
+
+	cover := &flac.Picture{
+		PictureType: flac.PictureFrontCover, MIME: "image/jpeg", Data: bytes.Repeat([]byte{0xAB}, 2000),
+	}
+
+	// No padding yet: adding blocks rewrites the file.
+	grown := update(func(md *flac.Metadata) {
+		md.SetVorbisComment(&flac.VorbisComment{
+			Vendor: "saprobe",
+			Tags:   []flac.Tag{{Name: "ARTIST", Value: "A"}, {Name: "TITLE", Value: "T"}},
+		})
+		md.AddPicture(cover)
+	})
+	if grown <= int64(buf.Len()) {
+		t.Errorf("rewrite: file did not grow (%d bytes)", grown)
+	}
+
+	// Smaller edits reuse the padding.
+	size := update(func(md *flac.Metadata) {
+		comment := md.VorbisComment()
+		comment.Set("artist", "B", "C")
+		comment.Add("ALBUM", "Album")
+		comment.Delete("TITLE")
+	})
+	if size != grown {
+		t.Errorf("in-place edit: file size %d, want %d", size, grown)
+	}
+
+	size = update(func(md *flac.Metadata) {
+		if got := md.VorbisComment().Get("ARTIST"); !reflect.DeepEqual(got, []string{"B", "C"}) {
+			t.Errorf("artists: got %q", got)
+		}
+
+		md.RemoveBlocks(flac.BlockPicture)
+		md.SetVorbisComment(nil)
+	})
+	if size != grown {
+		t.Errorf("in-place removal: file size %d, want %d", size, grown)
+	}
+
+	// Outgrowing the padding rewrites again.
+	size = update(func(md *flac.Metadata) {
+		md.AddPicture(&flac.Picture{PictureType: flac.PictureBackCover, MIME: "image/png", Data: make([]byte, 20000)})
+	})
+	if size <= grown {
+		t.Errorf("second rewrite: file size %d, want more than %d", size, grown)
+	}
+}
+
+// TestUpdateMetadataRoundTrip rewrites every block type unchanged and reads
+// back the same metadata.
+func TestUpdateMetadataRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	const sampleRate = 44100
+
+	srcPCM := generateTone(sampleRate, 16, 2, 1)
+	data := encodeVariable(t, srcPCM, sampleRate, true,
+		&meta.Block{
+			Header: meta.Header{Type: meta.TypeApplication, Length: 1},
+			Body:   &meta.Application{ID: 0x74657374, Data: []byte{1, 2, 3}},
+		},
+		&meta.Block{
+			Header: meta.Header{Type: meta.TypeCueSheet, Length: 1},
+			Body: &meta.CueSheet{
+				MCN:            "1234567890123",
+				NLeadInSamples: 88200,
+				IsCompactDisc:  true,
+				Tracks: []meta.CueSheetTrack{
+					{Num: 1, ISRC: "USABC1234567", IsAudio: true, Indicies: []meta.CueSheetTrackIndex{{Num: 1}}},
+					{
+						Offset: 22050 - 22050%588, Num: 2, HasPreEmphasis: true,
+						Indicies: []meta.CueSheetTrackIndex{{Num: 1}},
+					},
+					{Offset: 44100 - 44100%588, Num: 170},
+				},
+			},
+		},
+	)
+
+	path := filepath.Join(t.TempDir(), "roundtrip.flac")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	md := readMetadata(t, path)
+	if err := flac.UpdateMetadata(path, md); err != nil {
+		t.Fatalf("update metadata: %v", err)
+	}
+
+	if got := readMetadata(t, path); !reflect.DeepEqual(withoutPadding(got), withoutPadding(md)) {
+		t.Errorf("metadata: got %+v, want %+v", got, md)
+	}
+
+	for _, block := range readMetadata(t, path).Blocks {
+		if raw, ok := block.(*flac.RawBlock); ok {
+			t.Errorf("block of type %d did not parse back", raw.BlockType)
+		}
+	}
+}
+
+// TestUpdateMetadataChecks keeps the file's STREAMINFO under hand-built
+// metadata, and rejects a foreign STREAMINFO or a bad tag name without
+// touching the file.
+func TestUpdateMetadataChecks(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 1)
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "checks.flac")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	info := readMetadata(t, path).StreamInfo
+
+	foreign := readMetadata(t, path)
+	foreign.StreamInfo.TotalSamples++
+
+	badTag := readMetadata(t, path)
+	badTag.SetVorbisComment(&flac.VorbisComment{Tags: []flac.Tag{{Name: "A=B", Value: "C"}}})
+
+	for name, md := range map[string]*flac.Metadata{"stream info": foreign, "tag name": badTag} {
+		if err := flac.UpdateMetadata(path, md); !errors.Is(err, flac.ErrInvalidBlock) {
+			t.Errorf("%s: got %v, want ErrInvalidBlock", name, err)
+		}
+	}
+
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, buf.Bytes()) {
+		t.Fatalf("rejected updates changed the file (read error %v)", err)
+	}
+
+	handBuilt := &flac.Metadata{}
+	handBuilt.SetVorbisComment(&flac.VorbisComment{Tags: []flac.Tag{{Name: "TITLE", Value: "T"}}})
+
+	if err := flac.UpdateMetadata(path, handBuilt); err != nil {
+		t.Fatalf("hand-built metadata: %v", err)
+	}
+
+	md := readMetadata(t, path)
+	if md.StreamInfo != info || md.VorbisComment().Get("TITLE")[0] != "T" {
+		t.Errorf("hand-built metadata: got %+v", md)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read back: %v", err)
+	}
+
+	if pcm, _, err := flac.Decode(bytes.NewReader(data), flac.DecoderOptions{VerifyMD5: true}); err != nil ||
+		!bytes.Equal(pcm, srcPCM) {
+		t.Errorf("decode error %v, or audio differs from source", err)
+	}
+}
+
+// TestAddSeekTable adds a SEEKTABLE to an encoded file, in place thanks to its
+// padding, then replaces it, and checks the points match the ones the encoder
+// writes for the same options.
+func TestAddSeekTable(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 5)
+	seekOpts := flac.SeekTableOptions{Interval: time.Second, Points: []uint64{100000}}
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.SeekTable = seekOpts
+
+	var reference bytes.Buffer
+	if err := flac.Encode(&reference, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	opts.SeekTable = flac.SeekTableOptions{}
+	opts.Padding = 1024
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seektable.flac")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// check adds a table with seekOpts and returns its points.
+	check := func(seekOpts flac.SeekTableOptions) []flac.SeekPoint {
+		t.Helper()
+
+		if err := flac.AddSeekTable(path, seekOpts); err != nil {
+			t.Fatalf("add seek table: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		if len(data) != buf.Len() {
+			t.Errorf("file size %d, want %d (in place)", len(data), buf.Len())
+		}
+
+		pcm, _, err := flac.Decode(bytes.NewReader(data), flac.DecoderOptions{VerifyMD5: true})
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+
+		if !bytes.Equal(pcm, srcPCM) {
+			t.Fatal("decoded audio differs from source")
+		}
+
+		md := readMetadata(t, path)
+		if md.Blocks[0].Type() != flac.BlockSeekTable || md.SeekTable() == nil {
+			t.Fatalf("blocks: got %+v, want a leading SEEKTABLE", md.Blocks)
+		}
+
+		for _, block := range md.Blocks[1:] {
+			if block.Type() == flac.BlockSeekTable {
+				t.Error("more than one SEEKTABLE")
+			}
+		}
+
+		return md.SeekTable().Points
+	}
+
+	want, err := flac.ReadMetadata(bytes.NewReader(reference.Bytes()))
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+
+	if got := check(seekOpts); !reflect.DeepEqual(got, want.SeekTable().Points) {
+		t.Errorf("points: got %+v, want %+v", got, want.SeekTable().Points)
+	}
+
+	// Rebuilding replaces the table.
+	if got := check(flac.SeekTableOptions{SampleInterval: 20000}); len(got) != 12 {
+		t.Errorf("rebuilt table: got %d points, want 12", len(got))
+	}
+
+	if err := flac.AddSeekTable(path, flac.SeekTableOptions{}); !errors.Is(err, flac.ErrInvalidOptions) {
+		t.Errorf("no points: got %v, want ErrInvalidOptions", err)
+	}
+}
+
+func readMetadata(t *testing.T, path string) *flac.Metadata {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	md, err := flac.ReadMetadata(f)
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+
+	return md
+}
+
+// withoutPadding returns a copy of md without its PADDING blocks, which
+// UpdateMetadata manages itself.
+func withoutPadding(md *flac.Metadata) *flac.Metadata {
+	out := *md
+	out.Blocks = nil
+
+	for _, block := range md.Blocks {
+		if block.Type() != flac.BlockPadding {
+			out.Blocks = append(out.Blocks, block)
+		}
+	}
+
+	return &out
+}
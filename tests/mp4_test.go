@@ -0,0 +1,179 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// mp4Box returns an ISOBMFF box of type typ holding parts.
+func mp4Box(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body))) //nolint:gosec // Test data.
+
+	return append(append(box, typ...), body...)
+}
+
+// be32 returns values as big-endian 32-bit words.
+func be32(values ...int) []byte {
+	var out []byte
+	for _, v := range values {
+		out = binary.BigEndian.AppendUint32(out, uint32(v)) //nolint:gosec // Test data.
+	}
+
+	return out
+}
+
+// mp4Mux lays a FLAC stream, given as its metadata blocks and frames of
+// blockSize samples, out as an M4A file: frames in chunks of perChunk with
+// gaps between them, the movie box after the media data, and a timed text
+// track ahead of the audio one.
+func mp4Mux(blocks []byte, frames [][]byte, blockSize, total, perChunk int, format flac.PCMFormat) []byte {
+	ftyp := mp4Box("ftyp", []byte("M4A "), be32(0), []byte("M4A mp42isom"))
+
+	var (
+		mdat   []byte
+		sizes  []byte
+		chunks []int
+	)
+
+	for i, frame := range frames {
+		if i%perChunk == 0 {
+			mdat = append(mdat, "gap"...)
+			chunks = append(chunks, len(ftyp)+8+len(mdat))
+		}
+
+		mdat = append(mdat, frame...)
+		sizes = append(sizes, be32(len(frame))...)
+	}
+
+	n := len(frames)
+	last := n - (len(chunks)-1)*perChunk
+
+	entry := append(make([]byte, 6), 0, 1)
+	entry = append(entry, make([]byte, 8)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(format.Channels)) //nolint:gosec // Test data.
+	entry = binary.BigEndian.AppendUint16(entry, uint16(format.BitDepth)) //nolint:gosec // Test data.
+	entry = append(append(entry, 0, 0, 0, 0), be32(format.SampleRate<<16)...)
+
+	stbl := mp4Box("stbl",
+		mp4Box("stsd", be32(0, 1), mp4Box("fLaC", entry, mp4Box("dfLa", be32(0), blocks))),
+		mp4Box("stts", be32(0, 2, n-1, blockSize, 1, total-(n-1)*blockSize)),
+		mp4Box("stsc", be32(0, 2, 1, perChunk, 1, len(chunks), last, 1)),
+		mp4Box("stsz", be32(0, 0, n), sizes),
+		mp4Box("stco", be32(0, len(chunks)), be32(chunks...)),
+	)
+
+	trak := func(handler string, stbl []byte) []byte {
+		return mp4Box("trak", mp4Box("mdia",
+			mp4Box("mdhd", be32(0, 0, 0, format.SampleRate, total, 0)),
+			mp4Box("hdlr", be32(0, 0), []byte(handler), make([]byte, 13)),
+			mp4Box("minf", stbl),
+		))
+	}
+
+	text := trak("text", mp4Box("stbl", mp4Box("stsd", be32(0, 1), mp4Box("tx3g", make([]byte, 8)))))
+	moov := mp4Box("moov", mp4Box("mvhd", make([]byte, 100)), text, trak("soun", stbl))
+
+	return bytes.Join([][]byte{ftyp, mp4Box("mdat", mdat), moov}, nil)
+}
+
+// TestMP4Decoder decodes FLAC in MP4 muxed from an Ogg encode, whose packets
+// are the frames, and seeks through its sample tables.
+func TestMP4Decoder(t *testing.T) {
+	t.Parallel()
+
+	const blockSize = 4096
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 3)
+	total := len(srcPCM) / 4
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.BlockSize = blockSize
+	opts.Tags = []flac.Tag{{Name: "TITLE", Value: "Recorded"}}
+	opts.Ogg = flac.OggOptions{Enabled: true, Serial: 1}
+
+	var oga bytes.Buffer
+	if err := flac.Encode(&oga, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	// The mapping header, then one packet per metadata block, then the frames.
+	packets := oggDepacketize(oga.Bytes())
+	headers := 1 + int(binary.BigEndian.Uint16(packets[0][7:]))
+	blocks := bytes.Join(append([][]byte{packets[0][9+4:]}, packets[1:headers]...), nil)
+
+	m4a := mp4Mux(blocks, packets[headers:], blockSize, total, 5, format)
+
+	dec, err := flac.NewMP4Decoder(bytes.NewReader(m4a), flac.DecoderOptions{VerifyMD5: true})
+	if err != nil {
+		t.Fatalf("new mp4 decoder: %v", err)
+	}
+	defer dec.Close()
+
+	if dec.Format() != format || dec.Metadata().VorbisComment().Get("TITLE")[0] != "Recorded" {
+		t.Errorf("format %+v, metadata %+v", dec.Format(), dec.Metadata())
+	}
+
+	pcm, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+
+	for _, target := range []int{total / 2, 0, blockSize - 1, blockSize, 5*blockSize + 7, total - 1, total} {
+		if err := dec.SeekSample(uint64(target)); err != nil { //nolint:gosec // Test data.
+			t.Fatalf("seek %d: %v", target, err)
+		}
+
+		want := srcPCM[4*target : min(len(srcPCM), 4*(target+blockSize))]
+		got := make([]byte, len(want))
+
+		if _, err := io.ReadFull(dec, got); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("seek %d: read error %v, or audio differs from source", target, err)
+		}
+	}
+
+	if err := dec.SeekSample(uint64(total + 1)); !errors.Is(err, flac.ErrSeekOutOfRange) { //nolint:gosec // Test data.
+		t.Errorf("seek past end: got %v, want ErrSeekOutOfRange", err)
+	}
+
+	var native bytes.Buffer
+
+	opts.Ogg.Enabled = false
+	if err := flac.Encode(&native, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	fragmented := bytes.Replace(m4a, []byte("mvhd"), []byte("mvex"), 1)
+
+	for name, data := range map[string][]byte{"native": native.Bytes(), "fragmented": fragmented} {
+		if _, err := flac.NewMP4Decoder(bytes.NewReader(data)); !errors.Is(err, flac.ErrInvalidMP4) {
+			t.Errorf("%s: got %v, want ErrInvalidMP4", name, err)
+		}
+	}
+}
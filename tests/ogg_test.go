@@ -0,0 +1,627 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/mycophonic/agar/pkg/agar"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// oggPacketize splits a native FLAC stream into FLAC-in-Ogg packets: the
+// mapping header with STREAMINFO, one packet per metadata block, then the
+// audio in packets of chunk bytes. The decoder reads audio packets back to
+// back, so they need not hold exactly one frame each.
+func oggPacketize(native []byte, chunk int) [][]byte {
+	pos := 4 + 4 + 34
+	mapping := append([]byte("\x7fFLAC\x01\x00\x00\x00"), native[:pos]...)
+	packets := [][]byte{mapping}
+
+	for last := native[4]&0x80 != 0; !last; {
+		last = native[pos]&0x80 != 0
+		size := 4 + (int(native[pos+1])<<16 | int(native[pos+2])<<8 | int(native[pos+3]))
+		packets = append(packets, native[pos:pos+size])
+		pos += size
+	}
+
+	binary.BigEndian.PutUint16(mapping[7:], uint16(len(packets)-1)) //nolint:gosec // Few blocks.
+
+	for audio := native[pos:]; len(audio) > 0; {
+		n := min(chunk, len(audio))
+		packets = append(packets, audio[:n])
+		audio = audio[n:]
+	}
+
+	return packets
+}
+
+// oggMux lays packets out in pages of at most segments lacing values, so
+// packets span pages, with the header packets on pages of their own.
+func oggMux(packets [][]byte, serial uint32, segments, headers int) [][]byte {
+	var (
+		pages  [][]byte
+		lacing []byte
+		data   []byte
+		seq    uint32
+		flags  byte = 0x02
+	)
+
+	flush := func(eos bool) {
+		if eos {
+			flags |= 0x04
+		}
+
+		page := append([]byte("OggS\x00"), flags)
+		page = binary.LittleEndian.AppendUint64(page, 0)
+		page = binary.LittleEndian.AppendUint32(page, serial)
+		page = binary.LittleEndian.AppendUint32(page, seq)
+		page = binary.LittleEndian.AppendUint32(page, 0)
+		page = append(page, byte(len(lacing)))
+		page = append(append(page, lacing...), data...)
+		binary.LittleEndian.PutUint32(page[22:], oggChecksum(page))
+
+		pages = append(pages, page)
+		lacing, data, flags = lacing[:0], data[:0], 0
+		seq++
+	}
+
+	for i, packet := range packets {
+		for rest := packet; ; rest = rest[min(255, len(rest)):] {
+			if len(lacing) == segments {
+				flush(false)
+
+				if len(rest) < len(packet) {
+					flags = 0x01
+				}
+			}
+
+			lacing = append(lacing, byte(min(255, len(rest))))
+			data = append(data, rest[:min(255, len(rest))]...)
+
+			if len(rest) < 255 {
+				break
+			}
+		}
+
+		if i < headers {
+			flush(false)
+		}
+	}
+
+	flush(true)
+
+	return pages
+}
+
+// oggDepacketize returns the packets of a single-stream Ogg file.
+func oggDepacketize(data []byte) [][]byte {
+	var (
+		packets [][]byte
+		packet  []byte
+	)
+
+	for len(data) > 0 {
+		lacing := data[27 : 27+int(data[26])]
+		body := data[27+len(lacing):]
+
+		for _, l := range lacing {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+
+		data = body
+	}
+
+	return packets
+}
+
+// oggChecksum is the Ogg page CRC: polynomial 0x04C11DB7, unreflected.
+func oggChecksum(page []byte) uint32 {
+	var crc uint32
+
+	for _, b := range page {
+		crc ^= uint32(b) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+// TestOggDecoder decodes FLAC in Ogg, with packets spanning pages and a
+// second logical stream interleaved, and rejects corrupt pages.
+func TestOggDecoder(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 48000, BitDepth: flac.Depth24, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 24, 2, 2)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.Tags = []flac.Tag{{Name: "TITLE", Value: "Ogg"}}
+	opts.Padding = 300
+
+	var native bytes.Buffer
+	if err := flac.Encode(&native, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	pages := oggMux(oggPacketize(native.Bytes(), 700), 0x1234, 10, 3)
+
+	// A foreign stream multiplexed with the FLAC one is skipped.
+	other := oggMux([][]byte{[]byte("\x80theora"), bytes.Repeat([]byte{1}, 600)}, 7, 1, 1)
+	oga := bytes.Join(append(append([][]byte{other[0], pages[0]}, other[1:]...), pages[1:]...), nil)
+
+	dec, err := flac.NewOggDecoder(bytes.NewReader(oga), flac.DecoderOptions{VerifyMD5: true})
+	if err != nil {
+		t.Fatalf("new ogg decoder: %v", err)
+	}
+	defer dec.Close()
+
+	if dec.Format() != format || dec.Metadata().VorbisComment().Get("TITLE")[0] != "Ogg" {
+		t.Errorf("format %+v, metadata %+v", dec.Format(), dec.Metadata())
+	}
+
+	pcm, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) {
+		t.Error("decoded audio differs from source")
+	}
+
+	if err := dec.SeekSample(0); !errors.Is(err, flac.ErrNotSeekable) {
+		t.Errorf("seek: got %v, want ErrNotSeekable", err)
+	}
+
+	corrupt := bytes.Clone(oga)
+	corrupt[len(other[0])+40] ^= 1
+
+	if _, err := flac.NewOggDecoder(bytes.NewReader(corrupt)); !errors.Is(err, flac.ErrInvalidOgg) {
+		t.Errorf("corrupt page: got %v, want ErrInvalidOgg", err)
+	}
+
+	if _, err := flac.NewOggDecoder(bytes.NewReader(native.Bytes())); !errors.Is(err, flac.ErrInvalidOgg) {
+		t.Errorf("native stream: got %v, want ErrInvalidOgg", err)
+	}
+}
+
+// TestOggEncoder encodes to Ogg and checks the pages and the decoded audio,
+// for a complete input and for a streamed one patched on Close.
+func TestOggEncoder(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 3)
+	total := uint64(len(srcPCM) / 4)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.Tags = []flac.Tag{{Name: "TITLE", Value: "Muxed"}}
+	opts.Ogg = flac.OggOptions{Enabled: true, Serial: 42}
+
+	var oga bytes.Buffer
+	if err := flac.Encode(&oga, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	var granule int64
+
+	for data, seq := oga.Bytes(), uint32(0); len(data) > 0; seq++ {
+		flags := data[5]
+		pageGranule := int64(binary.LittleEndian.Uint64(data[6:])) //nolint:gosec // Test data.
+		lacing := data[27 : 27+int(data[26])]
+
+		if serial := binary.LittleEndian.Uint32(data[14:]); serial != 42 {
+			t.Fatalf("page %d: serial %d, want 42", seq, serial)
+		}
+
+		if got := binary.LittleEndian.Uint32(data[18:]); got != seq {
+			t.Fatalf("page %d: sequence number %d", seq, got)
+		}
+
+		if (flags&0x02 != 0) != (seq == 0) {
+			t.Errorf("page %d: flags 0x%02X", seq, flags)
+		}
+
+		if seq == 0 && (len(lacing) != 1 || lacing[0] != 51) {
+			t.Errorf("first page: lacing %v, want the mapping packet alone", lacing)
+		}
+
+		if pageGranule != -1 {
+			if pageGranule < granule {
+				t.Errorf("page %d: granule %d after %d", seq, pageGranule, granule)
+			}
+
+			granule = pageGranule
+		}
+
+		size := 27 + len(lacing)
+		for _, l := range lacing {
+			size += int(l)
+		}
+
+		if size == len(data) && flags&0x04 == 0 {
+			t.Error("last page is not flagged end-of-stream")
+		}
+
+		data = data[size:]
+	}
+
+	if granule != int64(total) { //nolint:gosec // Test data.
+		t.Errorf("final granule %d, want %d", granule, total)
+	}
+
+	dec, err := flac.NewOggDecoder(bytes.NewReader(oga.Bytes()), flac.DecoderOptions{VerifyMD5: true})
+	if err != nil {
+		t.Fatalf("new ogg decoder: %v", err)
+	}
+
+	pcm, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if !bytes.Equal(pcm, srcPCM) || dec.Metadata().VorbisComment().Get("TITLE")[0] != "Muxed" {
+		t.Error("decoded stream differs from source")
+	}
+
+	// Streamed to a file, the length and MD5 are patched into the first page.
+	path := filepath.Join(t.TempDir(), "streamed.oga")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	opts.Ogg.Serial = 0
+
+	enc, err := flac.NewEncoder(file, format, opts)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+
+	if _, err := enc.Write(srcPCM); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	_ = file.Close()
+
+	streamed, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	dec, err = flac.NewOggDecoder(streamed, flac.DecoderOptions{VerifyMD5: true})
+	if err != nil {
+		t.Fatalf("new ogg decoder: %v", err)
+	}
+	defer dec.Close()
+
+	if got := dec.Metadata().StreamInfo.TotalSamples; got != total || !dec.HasMD5() {
+		t.Errorf("patched stream info: %d samples, MD5 %v", got, dec.HasMD5())
+	}
+
+	if pcm, err := io.ReadAll(dec); err != nil || !bytes.Equal(pcm, srcPCM) {
+		t.Errorf("streamed: decode error %v, or audio differs from source", err)
+	}
+
+	opts.SeekTable.Points = []uint64{0}
+	if err := flac.Encode(io.Discard, srcPCM, format, opts); !errors.Is(err, flac.ErrInvalidOptions) {
+		t.Errorf("seek table in Ogg: got %v, want ErrInvalidOptions", err)
+	}
+}
+
+// TestOggEncoderDefaults encodes to Ogg without tags: the mapping still wants
+// a VORBIS_COMMENT as the first metadata block, and no page is left empty.
+func TestOggEncoderDefaults(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 1)
+
+	for _, padding := range []int{0, 1024} {
+		opts := flac.Level(flac.DefaultLevel)
+		opts.Padding = padding
+		opts.Ogg.Enabled = true
+
+		var oga bytes.Buffer
+		if err := flac.Encode(&oga, srcPCM, format, opts); err != nil {
+			t.Fatalf("padding %d: encode: %v", padding, err)
+		}
+
+		packets := oggDepacketize(oga.Bytes())
+		if len(packets) < 3 || packets[1][0]&0x7F != 4 {
+			t.Errorf("padding %d: second packet is not a VORBIS_COMMENT", padding)
+		}
+
+		for data, seq := oga.Bytes(), 0; len(data) > 0; seq++ {
+			lacing := data[27 : 27+int(data[26])]
+
+			size := 27 + len(lacing)
+			for _, l := range lacing {
+				size += int(l)
+			}
+
+			if len(lacing) == 0 && size < len(data) {
+				t.Errorf("padding %d: page %d is empty", padding, seq)
+			}
+
+			data = data[size:]
+		}
+
+		dec, err := flac.NewOggDecoder(bytes.NewReader(oga.Bytes()), flac.DecoderOptions{VerifyMD5: true})
+		if err != nil {
+			t.Fatalf("padding %d: new ogg decoder: %v", padding, err)
+		}
+
+		if pcm, err := io.ReadAll(dec); err != nil || !bytes.Equal(pcm, srcPCM) {
+			t.Errorf("padding %d: decode error %v, or audio differs from source", padding, err)
+		}
+
+		if comment := dec.Metadata().VorbisComment(); comment == nil || comment.Vendor == "" {
+			t.Errorf("padding %d: no vendor string", padding)
+		}
+
+		_ = dec.Close()
+	}
+}
+
+// TestOggEncoderTools decodes an encoded Ogg stream with the reference flac
+// binary and ffmpeg, which must both return the source audio.
+func TestOggEncoderTools(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 2)
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.Padding = 1024
+	opts.Ogg.Enabled = true
+
+	var oga bytes.Buffer
+	if err := flac.Encode(&oga, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "tone.oga")
+	if err := os.WriteFile(path, oga.Bytes(), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	t.Run("flac", func(t *testing.T) {
+		t.Parallel()
+
+		flacBin, err := agar.LookFor("flac")
+		if err != nil {
+			t.Skip("standalone flac binary not found")
+		}
+
+		if err := flacBinaryTest(flacBin, path); err != nil {
+			t.Fatal(err)
+		}
+
+		pcm, err := flacBinaryDecodeRaw(flacBin, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(pcm, srcPCM) {
+			t.Error("flac output differs from source")
+		}
+	})
+
+	t.Run("ffmpeg", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := agar.LookFor("ffmpeg"); err != nil {
+			t.Skip("ffmpeg not found")
+		}
+
+		pcm := agar.FFmpegDecode(t, agar.FFmpegDecodeOptions{Src: path, BitDepth: 16, Channels: 2})
+		if !bytes.Equal(pcm, srcPCM) {
+			t.Error("ffmpeg output differs from source")
+		}
+	})
+}
+
+// TestOggDecoderChained decodes a chain of two Ogg FLAC streams with
+// different formats and tags, reporting the boundary with ErrStreamChanged.
+// The first link may end without an EOS page, as when a source cuts a stream
+// to start the next one.
+func TestOggDecoderChained(t *testing.T) {
+	t.Parallel()
+
+	formats := []flac.PCMFormat{
+		{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2},
+		{SampleRate: 48000, BitDepth: flac.Depth24, Channels: 1},
+	}
+
+	var (
+		links   [][]byte
+		sources [][]byte
+	)
+
+	for i, format := range formats {
+		srcPCM := generateTone(format.SampleRate, int(format.BitDepth), int(format.Channels), 1)
+		sources = append(sources, srcPCM)
+
+		opts := flac.Level(flac.DefaultLevel)
+		opts.Tags = []flac.Tag{{Name: "TITLE", Value: string(rune('A' + i))}}
+		opts.Ogg.Enabled = true
+
+		var link bytes.Buffer
+		if err := flac.Encode(&link, srcPCM, format, opts); err != nil {
+			t.Fatalf("encode link %d: %v", i, err)
+		}
+
+		links = append(links, link.Bytes())
+	}
+
+	for _, eos := range []bool{true, false} {
+		first := links[0]
+		if !eos {
+			first = oggClearEOS(first)
+		}
+
+		chain := append(slices.Clone(first), links[1]...)
+
+		dec, err := flac.NewOggDecoder(bytes.NewReader(chain), flac.DecoderOptions{VerifyMD5: true})
+		if err != nil {
+			t.Fatalf("eos %v: new ogg decoder: %v", eos, err)
+		}
+
+		for i, format := range formats {
+			if dec.Format() != format || dec.Metadata().VorbisComment().Get("TITLE")[0] != string(rune('A'+i)) {
+				t.Errorf("eos %v: link %d: format %+v, metadata %+v", eos, i, dec.Format(), dec.Metadata())
+			}
+
+			var pcm bytes.Buffer
+
+			_, err := io.Copy(&pcm, dec)
+
+			want := flac.ErrStreamChanged
+			if i == len(formats)-1 {
+				want = nil
+			}
+
+			if !errors.Is(err, want) {
+				t.Fatalf("eos %v: link %d: got %v, want %v", eos, i, err, want)
+			}
+
+			if !bytes.Equal(pcm.Bytes(), sources[i]) {
+				t.Errorf("eos %v: link %d: decoded audio differs from source", eos, i)
+			}
+		}
+
+		_ = dec.Close()
+	}
+}
+
+// TestOggDecoderGrouped decodes the first of two FLAC streams multiplexed
+// from the start, with a skeleton-like stream, as one link: the other BOS
+// pages of the group start no new link.
+func TestOggDecoderGrouped(t *testing.T) {
+	t.Parallel()
+
+	var streams [][][]byte
+
+	formats := []flac.PCMFormat{
+		{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2},
+		{SampleRate: 48000, BitDepth: flac.Depth24, Channels: 1},
+	}
+
+	var sources [][]byte
+
+	for i, format := range formats {
+		srcPCM := generateTone(format.SampleRate, int(format.BitDepth), int(format.Channels), 1)
+		sources = append(sources, srcPCM)
+
+		var native bytes.Buffer
+		if err := flac.Encode(&native, srcPCM, format); err != nil {
+			t.Fatalf("encode stream %d: %v", i, err)
+		}
+
+		serial := uint32(10 + i) //nolint:gosec // Test data.
+		streams = append(streams, oggMux(oggPacketize(native.Bytes(), 500), serial, 8, 2))
+	}
+
+	streams = append(streams, oggMux([][]byte{[]byte("fishead\x00"), make([]byte, 64)}, 3, 1, 1))
+
+	// All BOS pages first, then the other pages in turn.
+	var pages [][]byte
+
+	for _, stream := range streams {
+		pages = append(pages, stream[0])
+	}
+
+	for i := 1; ; i++ {
+		n := len(pages)
+
+		for _, stream := range streams {
+			if i < len(stream) {
+				pages = append(pages, stream[i])
+			}
+		}
+
+		if len(pages) == n {
+			break
+		}
+	}
+
+	dec, err := flac.NewOggDecoder(bytes.NewReader(bytes.Join(pages, nil)), flac.DecoderOptions{VerifyMD5: true})
+	if err != nil {
+		t.Fatalf("new ogg decoder: %v", err)
+	}
+	defer dec.Close()
+
+	pcm, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if dec.Format() != formats[0] || !bytes.Equal(pcm, sources[0]) {
+		t.Errorf("format %+v, or decoded audio differs from the first stream", dec.Format())
+	}
+}
+
+// oggClearEOS returns a copy of a single-stream Ogg file whose last page is
+// not flagged end-of-stream.
+func oggClearEOS(data []byte) []byte {
+	data = slices.Clone(data)
+
+	var last []byte
+
+	for rest := data; len(rest) > 0; {
+		lacing := rest[27 : 27+int(rest[26])]
+
+		size := 27 + len(lacing)
+		for _, l := range lacing {
+			size += int(l)
+		}
+
+		last, rest = rest[:size], rest[size:]
+	}
+
+	last[5] &^= 0x04
+	binary.LittleEndian.PutUint32(last[22:], 0)
+	binary.LittleEndian.PutUint32(last[22:], oggChecksum(last))
+
+	return data
+}
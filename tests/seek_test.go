@@ -0,0 +1,323 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	goflac "github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// variableBlockSizes is the frame size cycle of encodeVariable, mixing tiny,
+// odd and large frames.
+//
+//nolint:gochecknoglobals
+var variableBlockSizes = []int{1024, 4608, 777, 16, 2048, 3000}
+
+// encodeVariable encodes 16-bit stereo PCM as a variable block-size stream
+// with goflac, which our encoder never produces. The extra metadata blocks
+// follow STREAMINFO; with withSeekTable, a SEEKTABLE pointing at every third
+// frame comes last.
+func encodeVariable(t *testing.T, pcm []byte, sampleRate int, withSeekTable bool, extra ...*meta.Block) []byte {
+	t.Helper()
+
+	const channels, bytesPerSample = 2, 2
+
+	total := len(pcm) / (channels * bytesPerSample)
+	info := &meta.StreamInfo{
+		BlockSizeMin:  16,
+		BlockSizeMax:  4608,
+		SampleRate:    uint32(sampleRate),
+		NChannels:     channels,
+		BitsPerSample: 16,
+		NSamples:      uint64(total),
+	}
+
+	writeFrames := func(w io.Writer, blocks ...*meta.Block) []meta.SeekPoint {
+		enc, err := goflac.NewEncoder(w, info, blocks...)
+		if err != nil {
+			t.Fatalf("goflac encoder: %v", err)
+		}
+
+		var (
+			points []meta.SeekPoint
+			buf    = w.(*bytes.Buffer)
+			start  = buf.Len()
+		)
+
+		for sample, i := 0, 0; sample < total; i++ {
+			size := min(variableBlockSizes[i%len(variableBlockSizes)], total-sample)
+
+			if i%3 == 0 {
+				points = append(points, meta.SeekPoint{
+					SampleNum: uint64(sample),
+					Offset:    uint64(buf.Len() - start),
+					NSamples:  uint16(size),
+				})
+			}
+
+			subframes := make([]*frame.Subframe, channels)
+			for ch := range subframes {
+				samples := make([]int32, size)
+				for j := range samples {
+					off := ((sample+j)*channels + ch) * bytesPerSample
+					samples[j] = int32(int16(binary.LittleEndian.Uint16(pcm[off:])))
+				}
+
+				subframes[ch] = &frame.Subframe{
+					SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+					Samples:   samples,
+					NSamples:  size,
+				}
+			}
+
+			err := enc.WriteFrame(&frame.Frame{
+				Header: frame.Header{
+					BlockSize:     uint16(size),
+					SampleRate:    info.SampleRate,
+					Channels:      frame.ChannelsLR,
+					BitsPerSample: info.BitsPerSample,
+				},
+				Subframes: subframes,
+			})
+			if err != nil {
+				t.Fatalf("write frame: %v", err)
+			}
+
+			sample += size
+		}
+
+		return points
+	}
+
+	// Frame offsets are relative to the first frame, so a table-less pass
+	// measures them for the real one.
+	var buf bytes.Buffer
+
+	points := writeFrames(&buf, extra...)
+	if !withSeekTable {
+		return buf.Bytes()
+	}
+
+	buf.Reset()
+	writeFrames(&buf, append(extra, &meta.Block{
+		Header: meta.Header{Type: meta.TypeSeekTable, Length: int64(len(points)) * 18},
+		Body:   &meta.SeekTable{Points: points},
+	})...)
+
+	return buf.Bytes()
+}
+
+// checkSeeks seeks the decoder to each target in turn and compares the next
+// readLen samples against the source.
+func checkSeeks(t *testing.T, dec *flac.Decoder, srcPCM []byte, targets []uint64, frameSize int) {
+	t.Helper()
+
+	const readLen = 300
+
+	total := uint64(len(srcPCM) / frameSize)
+
+	for _, target := range targets {
+		if err := dec.SeekSample(target); err != nil {
+			t.Fatalf("seek to %d: %v", target, err)
+		}
+
+		want := srcPCM[target*uint64(frameSize) : min(target+readLen, total)*uint64(frameSize)]
+		got := make([]byte, len(want))
+
+		if _, err := io.ReadFull(dec, got); err != nil {
+			t.Fatalf("read after seek to %d: %v", target, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("seek to %d: decoded samples differ from source", target)
+		}
+	}
+}
+
+// seekTargets returns the stream edges, frame edges around blockSize and a
+// batch of random samples, in random order.
+func seekTargets(total uint64, blockSize int) []uint64 {
+	bs := uint64(blockSize)
+	targets := []uint64{0, 1, bs - 1, bs, bs + 1, total / 2, total - bs, total - 1}
+
+	rng := rand.New(rand.NewPCG(total, bs))
+	for range 40 {
+		targets = append(targets, rng.Uint64N(total))
+	}
+
+	rng.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+
+	return targets
+}
+
+// TestDecoderSeekSample seeks fixed block-size streams from our encoder by
+// bisection, since they carry no SEEKTABLE.
+func TestDecoderSeekSample(t *testing.T) {
+	t.Parallel()
+
+	for _, bitDepth := range []int{16, 24} {
+		format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.BitDepth(bitDepth), Channels: 2}
+		srcPCM := generateTone(format.SampleRate, bitDepth, 2, 3)
+		frameSize := 2 * format.BitDepth.BytesPerSample()
+		total := uint64(len(srcPCM) / frameSize)
+
+		var buf bytes.Buffer
+		if err := flac.Encode(&buf, srcPCM, format, flac.Level(0)); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+
+		dec, err := flac.NewDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("new decoder: %v", err)
+		}
+
+		checkSeeks(t, dec, srcPCM, seekTargets(total, 1152), frameSize)
+
+		// Seeking to the end leaves nothing to read; past it fails.
+		if err := dec.SeekSample(total); err != nil {
+			t.Fatalf("seek to end: %v", err)
+		}
+
+		if n, err := dec.Read(make([]byte, 16)); n != 0 || !errors.Is(err, io.EOF) {
+			t.Errorf("read at end: got %d, %v; want 0, EOF", n, err)
+		}
+
+		if err := dec.SeekSample(total + 1); !errors.Is(err, flac.ErrSeekOutOfRange) {
+			t.Errorf("seek past end: got %v, want ErrSeekOutOfRange", err)
+		}
+
+		// A failed seek is sticky until the next successful one.
+		if _, err := dec.Read(make([]byte, 16)); !errors.Is(err, flac.ErrSeekOutOfRange) {
+			t.Errorf("read after failed seek: got %v, want ErrSeekOutOfRange", err)
+		}
+
+		checkSeeks(t, dec, srcPCM, []uint64{total / 3}, frameSize)
+
+		_ = dec.Close()
+	}
+}
+
+// TestDecoderSeekVariable seeks variable block-size streams, with and without
+// a SEEKTABLE to narrow the search.
+func TestDecoderSeekVariable(t *testing.T) {
+	t.Parallel()
+
+	const sampleRate, frameSize = 44100, 4
+
+	srcPCM := generateTone(sampleRate, 16, 2, 2)
+	total := uint64(len(srcPCM) / frameSize)
+
+	for _, withSeekTable := range []bool{false, true} {
+		data := encodeVariable(t, srcPCM, sampleRate, withSeekTable)
+
+		dec, err := flac.NewDecoder(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("new decoder: %v", err)
+		}
+
+		// 1024+4608+777+16 puts frame edges at 5632, 6409 and 6425.
+		targets := append(seekTargets(total, 1024), 5631, 5632, 6409, 6410, 6424, 6425)
+		checkSeeks(t, dec, srcPCM, targets, frameSize)
+
+		_ = dec.Close()
+	}
+}
+
+// TestDecoderSeeker checks the io.Seeker implementation over PCM bytes,
+// including offsets that fall inside a sample.
+func TestDecoderSeeker(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth24, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 24, 2, 1)
+	size := int64(len(srcPCM))
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	dec, err := flac.NewDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+
+	readAt := func(want int64, n int) {
+		t.Helper()
+
+		got := make([]byte, n)
+		if _, err := io.ReadFull(dec, got); err != nil {
+			t.Fatalf("read at %d: %v", want, err)
+		}
+
+		if !bytes.Equal(got, srcPCM[want:want+int64(n)]) {
+			t.Fatalf("read at %d: bytes differ from source", want)
+		}
+	}
+
+	steps := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{60000, io.SeekStart, 60000},
+		// Inside a 6-byte sample.
+		{60003, io.SeekStart, 60003},
+		// Relative to the 100 bytes read after the previous seek.
+		{-1000, io.SeekCurrent, 59103},
+		{-600, io.SeekEnd, size - 600},
+		{0, io.SeekStart, 0},
+	}
+
+	for _, step := range steps {
+		pos, err := dec.Seek(step.offset, step.whence)
+		if err != nil {
+			t.Fatalf("seek(%d, %d): %v", step.offset, step.whence, err)
+		}
+
+		if pos != step.want {
+			t.Fatalf("seek(%d, %d) = %d, want %d", step.offset, step.whence, pos, step.want)
+		}
+
+		readAt(pos, 100)
+	}
+
+	if _, err := dec.Seek(-1, io.SeekStart); !errors.Is(err, flac.ErrSeekOutOfRange) {
+		t.Errorf("negative seek: got %v, want ErrSeekOutOfRange", err)
+	}
+
+	// The rest of the stream still reads after a rejected seek.
+	rest, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatalf("read to end: %v", err)
+	}
+
+	if !bytes.Equal(rest, srcPCM[100:]) {
+		t.Error("remaining bytes differ from source")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	flac "github.com/mycophonic/saprobe-flac"
+)
+
+// splitCue has a pregap on track 2 and none on the other tracks.
+const splitCue = `TITLE "Album"
+PERFORMER "Band"
+FILE "image.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "One"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Two"
+    PERFORMER "Guest"
+    ISRC USABC1234567
+    INDEX 00 00:00:60
+    INDEX 01 00:01:00
+  TRACK 03 AUDIO
+    TITLE "Three"
+    INDEX 01 00:02:00
+`
+
+// TestDecoderSplit splits an image with an embedded cue sheet in every pregap
+// mode and checks the tracks against the source, sample for sample.
+func TestDecoderSplit(t *testing.T) {
+	t.Parallel()
+
+	const frameSize = 4
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 3)
+	total := uint64(len(srcPCM) / frameSize)
+
+	cue, err := flac.ParseCueFile(strings.NewReader(splitCue))
+	if err != nil {
+		t.Fatalf("parse cue: %v", err)
+	}
+
+	sheet, err := cue.CueSheet(format.SampleRate, total)
+	if err != nil {
+		t.Fatalf("cue sheet: %v", err)
+	}
+
+	opts := flac.Level(flac.DefaultLevel)
+	opts.CueSheet = sheet
+	opts.Tags = []flac.Tag{
+		{Name: "ALBUM", Value: "Tagged Album"}, {Name: "TITLE", Value: "Image"}, {Name: "DATE", Value: "1999"},
+	}
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	const pregap, two, three = 60 * 588, 75 * 588, 150 * 588
+
+	for _, tc := range []struct {
+		mode   flac.PregapMode
+		bounds [][2]uint64
+	}{
+		{flac.PregapAppend, [][2]uint64{{0, two}, {two, three}, {three, total}}},
+		{flac.PregapPrepend, [][2]uint64{{0, pregap}, {pregap, three}, {three, total}}},
+		{flac.PregapDiscard, [][2]uint64{{0, pregap}, {two, three}, {three, total}}},
+	} {
+		dec, err := flac.NewDecoder(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("new decoder: %v", err)
+		}
+
+		var got [][2]uint64
+
+		// Consume only part of the first track: Split drains the rest.
+		err = dec.Split(flac.SplitOptions{Pregap: tc.mode, Cue: cue}, func(track flac.SplitTrack, pcm io.Reader) error {
+			got = append(got, [2]uint64{track.Start, track.End})
+
+			limit := int64(len(srcPCM))
+			if len(got) == 1 {
+				limit = 1000
+			}
+
+			data, err := io.ReadAll(io.LimitReader(pcm, limit))
+			if err != nil {
+				return err
+			}
+
+			if want := srcPCM[track.Start*frameSize:][:len(data)]; !bytes.Equal(data, want) {
+				t.Errorf("mode %d track %d: samples differ from source", tc.mode, track.Number)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("mode %d: split: %v", tc.mode, err)
+		}
+
+		if !reflect.DeepEqual(got, tc.bounds) {
+			t.Errorf("mode %d: bounds %v, want %v", tc.mode, got, tc.bounds)
+		}
+
+		_ = dec.Close()
+	}
+
+	dec, err := flac.NewDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+
+	tracks, err := dec.Tracks(flac.SplitOptions{Cue: cue})
+	if err != nil {
+		t.Fatalf("tracks: %v", err)
+	}
+
+	want := []flac.Tag{
+		{Name: "ALBUM", Value: "Tagged Album"}, {Name: "DATE", Value: "1999"},
+		{Name: "ALBUMARTIST", Value: "Band"}, {Name: "ARTIST", Value: "Guest"},
+		{Name: "TITLE", Value: "Two"}, {Name: "TRACKNUMBER", Value: "2"},
+		{Name: "TRACKTOTAL", Value: "3"}, {Name: "ISRC", Value: "USABC1234567"},
+	}
+	if !reflect.DeepEqual(tracks[1].Tags, want) {
+		t.Errorf("track 2 tags: got %v, want %v", tracks[1].Tags, want)
+	}
+}
+
+// TestDecoderSplitExternal splits a stream without an embedded cue sheet by
+// an external one.
+func TestDecoderSplitExternal(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 3)
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	dec, err := flac.NewDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+
+	if _, err := dec.Tracks(flac.SplitOptions{}); !errors.Is(err, flac.ErrNoCueSheet) {
+		t.Errorf("no cue sheet: got %v, want ErrNoCueSheet", err)
+	}
+
+	cue, err := flac.ParseCueFile(strings.NewReader(splitCue))
+	if err != nil {
+		t.Fatalf("parse cue: %v", err)
+	}
+
+	sheet, err := cue.CueSheet(format.SampleRate, uint64(len(srcPCM)/4))
+	if err != nil {
+		t.Fatalf("cue sheet: %v", err)
+	}
+
+	var joined bytes.Buffer
+
+	err = dec.Split(flac.SplitOptions{CueSheet: sheet}, func(_ flac.SplitTrack, pcm io.Reader) error {
+		_, err := io.Copy(&joined, pcm)
+
+		return err
+	})
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+
+	// Gapless: the tracks add up to the image.
+	if !bytes.Equal(joined.Bytes(), srcPCM) {
+		t.Error("joined tracks differ from source")
+	}
+}
+
+// TestDecoderSplitDataTrack skips a leading data track, as on mixed-mode CDs,
+// without folding its region into the first audio track.
+func TestDecoderSplitDataTrack(t *testing.T) {
+	t.Parallel()
+
+	format := flac.PCMFormat{SampleRate: 44100, BitDepth: flac.Depth16, Channels: 2}
+	srcPCM := generateTone(format.SampleRate, 16, 2, 1)
+	total := uint64(len(srcPCM) / 4)
+
+	var buf bytes.Buffer
+	if err := flac.Encode(&buf, srcPCM, format); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	dec, err := flac.NewDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	defer dec.Close()
+
+	sheet := &flac.CueSheet{Tracks: []flac.CueTrack{
+		{Number: 1, Indices: []flac.CueIndex{{Number: 1}}},
+		{Offset: 10000, Number: 2, IsAudio: true, Indices: []flac.CueIndex{{Number: 0}, {Offset: 2000, Number: 1}}},
+		{Offset: 30000, Number: 3, IsAudio: true, Indices: []flac.CueIndex{{Number: 1}}},
+		{Offset: total, Number: 255},
+	}}
+
+	for _, tc := range []struct {
+		mode   flac.PregapMode
+		bounds [][2]uint64
+	}{
+		{flac.PregapAppend, [][2]uint64{{12000, 30000}, {30000, total}}},
+		{flac.PregapPrepend, [][2]uint64{{10000, 30000}, {30000, total}}},
+	} {
+		tracks, err := dec.Tracks(flac.SplitOptions{Pregap: tc.mode, CueSheet: sheet})
+		if err != nil {
+			t.Fatalf("mode %d: tracks: %v", tc.mode, err)
+		}
+
+		var got [][2]uint64
+		for _, track := range tracks {
+			got = append(got, [2]uint64{track.Start, track.End})
+		}
+
+		if !reflect.DeepEqual(got, tc.bounds) {
+			t.Errorf("mode %d: bounds %v, want %v", tc.mode, got, tc.bounds)
+		}
+	}
+}
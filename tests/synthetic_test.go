@@ -191,6 +191,13 @@ func runConformanceTest(
 		if err := encodeSaprobe(srcPCM, encPath, bitDepth, sampleRate, channels); err != nil {
 			t.Fatalf("saprobe encode: %v", err)
 		}
+
+		// White noise drives the encoder into escaped partitions; have the reference validate them.
+		if flacBin != "" {
+			if err := flacBinaryTest(flacBin, encPath); err != nil {
+				t.Errorf("reference decoder rejects saprobe output: %v", err)
+			}
+		}
 	case encoderFlacBinary:
 		if err := flacBinaryEncode(flacBin, srcPath, encPath, bitDepth, sampleRate, channels); err != nil {
 			t.Fatalf("flac encode: %v", err)